@@ -0,0 +1,356 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+// Command cachetool Offline inspection and maintenance of the persisted work cache: dump, merge, validate, prune, convert.
+// The work cache service should not be running on the same files meanwhile.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/workcache"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: cachetool <command> [options] <file> ...
+
+Commands:
+  dump      Print the entries, as JSON lines or CSV, optionally filtered
+  merge     Merge several cache files into one
+  validate  Check the work of all entries
+  prune     Remove old (and optionally invalid) entries, in place
+  convert   Convert a cache to another persistence mode or compression
+
+Use 'cachetool <command> -h' for the options of a command.
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "merge":
+		err = runMerge(os.Args[2:])
+	case "validate":
+		err = runValidate(os.Args[2:])
+	case "prune":
+		err = runPrune(os.Args[2:])
+	case "convert":
+		err = runConvert(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %v\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// newFlagSet Create the flag set of a command, with the persistence mode option common to all
+func newFlagSet(name string, args string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cachetool %v [options] %v\n", name, args)
+		fs.PrintDefaults()
+	}
+	mode := fs.String("mode", workcache.PersistModeFile, "persistence mode of the cache: file or kv")
+	return fs, mode
+}
+
+// fileArgs Return the file arguments of a command; exactly count of them, or at least one if count is 0
+func fileArgs(fs *flag.FlagSet, count int) ([]string, error) {
+	files := fs.Args()
+	if (count > 0 && len(files) != count) || len(files) == 0 {
+		fs.Usage()
+		return nil, fmt.Errorf("wrong number of file arguments")
+	}
+	return files, nil
+}
+
+// entryFilter Criteria for selecting entries; zero values mean no filtering
+type entryFilter struct {
+	account       string
+	status        string
+	maxAgeDays    float64
+	minDifficulty uint64
+}
+
+func (f *entryFilter) match(e workcache.CacheEntry, now int64) bool {
+	if len(f.account) > 0 && e.Account() != f.account {
+		return false
+	}
+	if len(f.status) > 0 && e.Status() != f.status {
+		return false
+	}
+	if f.maxAgeDays > 0 && float64(now-e.TimeComputed())/float64(3600*24) > f.maxAgeDays {
+		return false
+	}
+	if f.minDifficulty > 0 && e.Difficulty() < f.minDifficulty {
+		return false
+	}
+	return true
+}
+
+func checkCompression(compression string) error {
+	if compression != workcache.CompressionNone && compression != workcache.CompressionGzip && compression != workcache.CompressionZstd {
+		return fmt.Errorf("unknown compression %v", compression)
+	}
+	return nil
+}
+
+func parseDifficulty(val string) (uint64, error) {
+	if len(val) == 0 {
+		return 0, nil
+	}
+	diff, err := strconv.ParseUint(val, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid difficulty %v, expected hex", val)
+	}
+	return diff, nil
+}
+
+func runDump(args []string) error {
+	fs, mode := newFlagSet("dump", "<file>")
+	format := fs.String("format", "json", "output format: json (one object per line) or csv")
+	var filter entryFilter
+	fs.StringVar(&filter.account, "account", "", "only entries of this account")
+	fs.StringVar(&filter.status, "status", "", "only entries with this status")
+	fs.Float64Var(&filter.maxAgeDays, "max-age-days", 0, "only entries computed within this many days")
+	minDifficulty := fs.String("min-difficulty", "", "only entries with at least this difficulty (hex)")
+	fs.Parse(args)
+	files, err := fileArgs(fs, 1)
+	if err != nil {
+		return err
+	}
+	filter.minDifficulty, err = parseDifficulty(*minDifficulty)
+	if err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %v", *format)
+	}
+
+	entries, err := workcache.ReadCacheStore(*mode, files[0])
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	var csvWriter *csv.Writer = nil
+	if *format == "csv" {
+		csvWriter = csv.NewWriter(os.Stdout)
+		csvWriter.Write([]string{"hash", "work", "difficulty", "multiplier", "account", "status", "time_computed", "time_added"})
+	}
+	cnt := 0
+	for _, e := range entries {
+		if !filter.match(e, now) {
+			continue
+		}
+		cnt++
+		if csvWriter == nil {
+			fmt.Println(workcache.EncodeCacheEntry(e))
+			continue
+		}
+		csvWriter.Write([]string{e.Hash(), e.Work(), strconv.FormatUint(e.Difficulty(), 16),
+			strconv.FormatFloat(e.Multiplier(), 'f', -1, 64), e.Account(), e.Status(),
+			strconv.FormatInt(e.TimeComputed(), 10), strconv.FormatInt(e.TimeAdded(), 10)})
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%v entries of %v\n", cnt, len(entries))
+	return nil
+}
+
+// preferEntry Return true if entry a is better than b, for the same hash: valid, higher difficulty, more recent
+func preferEntry(a workcache.CacheEntry, b workcache.CacheEntry) bool {
+	if (a.Status() == "valid") != (b.Status() == "valid") {
+		return a.Status() == "valid"
+	}
+	if a.Difficulty() != b.Difficulty() {
+		return a.Difficulty() > b.Difficulty()
+	}
+	return a.TimeComputed() > b.TimeComputed()
+}
+
+func runMerge(args []string) error {
+	fs, mode := newFlagSet("merge", "-out <file> <file> <file> ...")
+	out := fs.String("out", "", "output file (mandatory); may be one of the input files")
+	outMode := fs.String("out-mode", "", "persistence mode of the output; default same as -mode")
+	compression := fs.String("compression", workcache.CompressionNone, "compression of the output file: none, gzip or zstd")
+	fs.Parse(args)
+	files, err := fileArgs(fs, 0)
+	if err != nil {
+		return err
+	}
+	if len(*out) == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing -out")
+	}
+	if err := checkCompression(*compression); err != nil {
+		return err
+	}
+	if len(*outMode) == 0 {
+		*outMode = *mode
+	}
+
+	merged := map[string]workcache.CacheEntry{}
+	var order []string
+	for _, file := range files {
+		entries, err := workcache.ReadCacheStore(*mode, file)
+		if err != nil {
+			return fmt.Errorf("%v: %v", file, err.Error())
+		}
+		for _, e := range entries {
+			prev, ok := merged[e.Hash()]
+			if !ok {
+				order = append(order, e.Hash())
+			}
+			if !ok || preferEntry(e, prev) {
+				merged[e.Hash()] = e
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Read %v entries from %v\n", len(entries), file)
+	}
+	result := make([]workcache.CacheEntry, 0, len(order))
+	for _, hash := range order {
+		result = append(result, merged[hash])
+	}
+	err = workcache.WriteCacheStore(result, *outMode, *out, *compression)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Written %v entries to %v\n", len(result), *out)
+	return nil
+}
+
+func runValidate(args []string) error {
+	fs, mode := newFlagSet("validate", "<file>")
+	verbose := fs.Bool("v", false, "list the invalid entries")
+	fs.Parse(args)
+	files, err := fileArgs(fs, 1)
+	if err != nil {
+		return err
+	}
+
+	entries, err := workcache.ReadCacheStore(*mode, files[0])
+	if err != nil {
+		return err
+	}
+	cntInvalid := 0
+	cntDiffMismatch := 0
+	for _, e := range entries {
+		actual, err := workcache.ValidateCacheEntry(e)
+		if err != nil {
+			cntInvalid++
+			if *verbose {
+				fmt.Printf("invalid  %v  %v\n", e.Hash(), err.Error())
+			}
+			continue
+		}
+		if e.Difficulty() != 0 && actual.Difficulty() != e.Difficulty() {
+			cntDiffMismatch++
+			if *verbose {
+				fmt.Printf("difficulty mismatch  %v  stored %x actual %x\n", e.Hash(), e.Difficulty(), actual.Difficulty())
+			}
+		}
+	}
+	fmt.Printf("%v entries, %v invalid, %v with wrong stored difficulty\n", len(entries), cntInvalid, cntDiffMismatch)
+	if cntInvalid > 0 {
+		return fmt.Errorf("%v invalid entries", cntInvalid)
+	}
+	return nil
+}
+
+func runPrune(args []string) error {
+	fs, mode := newFlagSet("prune", "<file>")
+	maxAgeDays := fs.Float64("max-age-days", 0, "remove entries computed more than this many days ago")
+	removeInvalid := fs.Bool("invalid", false, "remove entries with invalid work")
+	compression := fs.String("compression", workcache.CompressionNone, "compression of the rewritten file: none, gzip or zstd")
+	dryRun := fs.Bool("n", false, "dry run, only report what would be removed")
+	fs.Parse(args)
+	files, err := fileArgs(fs, 1)
+	if err != nil {
+		return err
+	}
+	if *maxAgeDays <= 0 && !*removeInvalid {
+		fs.Usage()
+		return fmt.Errorf("nothing to prune, specify -max-age-days and/or -invalid")
+	}
+	if err := checkCompression(*compression); err != nil {
+		return err
+	}
+
+	entries, err := workcache.ReadCacheStore(*mode, files[0])
+	if err != nil {
+		return err
+	}
+	filter := entryFilter{maxAgeDays: *maxAgeDays}
+	now := time.Now().Unix()
+	kept := make([]workcache.CacheEntry, 0, len(entries))
+	cntOld := 0
+	cntInvalid := 0
+	for _, e := range entries {
+		if !filter.match(e, now) {
+			cntOld++
+			continue
+		}
+		if *removeInvalid {
+			if _, err := workcache.ValidateCacheEntry(e); err != nil {
+				cntInvalid++
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	fmt.Printf("%v entries, %v old, %v invalid, %v kept\n", len(entries), cntOld, cntInvalid, len(kept))
+	if *dryRun || len(kept) == len(entries) {
+		return nil
+	}
+	return workcache.WriteCacheStore(kept, *mode, files[0], *compression)
+}
+
+func runConvert(args []string) error {
+	fs, mode := newFlagSet("convert", "<input file> <output file>")
+	outMode := fs.String("out-mode", "", "persistence mode of the output; default same as -mode")
+	compression := fs.String("compression", workcache.CompressionNone, "compression of the output file: none, gzip or zstd")
+	fs.Parse(args)
+	files, err := fileArgs(fs, 2)
+	if err != nil {
+		return err
+	}
+	if len(*outMode) == 0 {
+		*outMode = *mode
+	}
+	if err := checkCompression(*compression); err != nil {
+		return err
+	}
+
+	entries, err := workcache.ReadCacheStore(*mode, files[0])
+	if err != nil {
+		return err
+	}
+	err = workcache.WriteCacheStore(entries, *outMode, files[1], *compression)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Converted %v entries, %v (%v) -> %v (%v, compression %v)\n",
+		len(entries), files[0], *mode, files[1], *outMode, *compression)
+	return nil
+}
@@ -1,5 +1,11 @@
 module github.com/catenocrypt/nano-work-cache
 
-require github.com/spf13/viper v1.6.0
+require (
+	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.11.13
+	github.com/spf13/viper v1.6.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+)
 
 go 1.13
@@ -3,8 +3,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/catenocrypt/nano-work-cache/restapi"
 	"github.com/catenocrypt/nano-work-cache/rpcclient"
@@ -35,14 +40,56 @@ func main() {
 	fmt.Printf("  NodeRpc          %v \n", rpcUrl)
 	fmt.Printf("  NodeRpcWork      %v \n", rpcWorkUrl)
 	fmt.Printf("  ListenIpPort     %v \n", workcache.ConfigListenIpPort())
+	fmt.Printf("  CachePeristFileName  %v \n", workcache.ConfigGetString("Main.CachePeristFileName"))
+	fmt.Printf("  CachePersistMode  %v \n", workcache.ConfigCachePersistMode())
+	fmt.Printf("  CacheCompression  %v \n", workcache.ConfigCacheCompression())
 	fmt.Printf("  RestMaxActiveRequests  %v \n", workcache.ConfigRestMaxActiveRequests())
 	fmt.Printf("  BackgroundWorkerCount  %v \n", workcache.ConfigBackgroundWorkerCount())
 	fmt.Printf("  MaxOutRequests   %v \n", workcache.ConfigMaxOutRequests())
 	fmt.Printf("  EnablePregeneration  %v \n", workcache.ConfigEnablePregeneration())
+	fmt.Printf("  EnableWebSocket  %v \n", workcache.ConfigEnableWebSocket())
 	fmt.Printf("  PregenerationQueueSize  %v \n", workcache.ConfigPregenerationQueueSize())
 	fmt.Printf("  MaxCacheAgeDays  %v \n", workcache.ConfigMaxCacheAgeDays())
+	fmt.Printf("  MaxCacheEntries  %v \n", workcache.ConfigMaxCacheEntries())
+	fmt.Printf("  MaxCacheSizeMB   %v \n", workcache.ConfigMaxCacheSizeMB())
+	fmt.Printf("  WorkWaitTimeoutSec  %v \n", workcache.ConfigWorkWaitTimeoutSec())
+	fmt.Printf("  RpcTimeoutSec    %v \n", workcache.ConfigRpcTimeoutSec())
+	fmt.Printf("  WorkTimeoutSec   %v \n", workcache.ConfigWorkTimeoutSec())
+	fmt.Printf("  EnableWorkCancel  %v \n", workcache.ConfigEnableWorkCancel())
+	fmt.Printf("  ShutdownTimeoutSec  %v \n", workcache.ConfigShutdownTimeoutSec())
+	fmt.Printf("  CpuWorkMode      %v \n", workcache.ConfigCpuWorkMode())
+	fmt.Printf("  CpuWorkThreads   %v \n", workcache.ConfigCpuWorkThreads())
+	fmt.Printf("  CpuWorkTimeoutSec  %v \n", workcache.ConfigCpuWorkTimeoutSec())
+	fmt.Printf("  WorkSourceStrategy  %v \n", workcache.ConfigWorkSourceStrategy())
+	for _, source := range workcache.ConfigWorkSources() {
+		fmt.Printf("  WorkSource       %v %v  weight %v maxActive %v \n", source.Type, source.Url, source.Weight, source.MaxActive)
+	}
+
+	ctx := context.Background()
+	client := rpcclient.NewClient(rpcUrl, rpcWorkUrl)
+	client.SetTimeouts(time.Duration(workcache.ConfigRpcTimeoutSec())*time.Second, time.Duration(workcache.ConfigWorkTimeoutSec())*time.Second)
+	service, err := workcache.NewService(workcache.ConfigServiceOptions(client))
+	check(err)
+	check(service.Start(ctx))
+	server := restapi.NewServer(service, restapi.Options{
+		ListenIpPort:        workcache.ConfigListenIpPort(),
+		MaxActiveRequests:   workcache.ConfigRestMaxActiveRequests(),
+		EnablePregeneration: workcache.ConfigEnablePregeneration() >= 1,
+		ShutdownTimeout:     time.Duration(workcache.ConfigShutdownTimeoutSec()) * time.Second,
+		EnableWebSocket:     workcache.ConfigEnableWebSocket() >= 1,
+	})
+	check(server.Start(ctx))
 
-	rpcclient.Init(rpcUrl, rpcWorkUrl)
-	workcache.Start()
-	restapi.Start()
+	// serve until interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Println("Signal received, shutting down;", sig)
+	case <-server.Done():
+		log.Println("HTTP server has stopped, shutting down")
+	}
+	// stop taking requests first, then the background work, and save the cache
+	server.Stop()
+	service.Stop()
 }
@@ -0,0 +1,231 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+// Package metrics Minimal metrics (counters, gauges, histograms), exported in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// metric Common interface of all metric types
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry A set of metrics, exported together
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+// NewRegistry Create an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	r.metrics = append(r.metrics, m)
+	r.lock.Unlock()
+}
+
+// Counter A monotonically increasing value, safe for concurrent use
+type Counter struct {
+	metricName string
+	help       string
+	value      int64
+}
+
+// NewCounter Create and register a counter
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	r.register(c)
+	return c
+}
+
+// Inc Increment the counter by one
+func (c *Counter) Inc() { atomic.AddInt64(&c.value, 1) }
+
+// Add Increment the counter by n
+func (c *Counter) Add(n int64) { atomic.AddInt64(&c.value, n) }
+
+// Value Return the current value
+func (c *Counter) Value() int64 { return atomic.LoadInt64(&c.value) }
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%v %v\n", c.metricName, c.Value())
+}
+
+// CounterFunc A counter whose value is obtained by calling a function at export time; for values counted elsewhere
+type CounterFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// NewCounterFunc Create and register a counter, fn is called to obtain the value
+func (r *Registry) NewCounterFunc(name string, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{metricName: name, help: help, fn: fn}
+	r.register(c)
+	return c
+}
+
+func (c *CounterFunc) name() string { return c.metricName }
+
+func (c *CounterFunc) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%v %v\n", c.metricName, formatFloat(c.fn()))
+}
+
+// GaugeFunc A gauge whose value is obtained by calling a function at export time
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// NewGaugeFunc Create and register a gauge, fn is called to obtain the value
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%v %v\n", g.metricName, formatFloat(g.fn()))
+}
+
+// DefaultDurationBuckets Histogram buckets for durations in seconds, from 5 ms to 60 s
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60}
+
+// histogramValues The observed values of a histogram (of one label value)
+type histogramValues struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram Distribution of observed values, in buckets; optionally per value of one label
+type Histogram struct {
+	metricName string
+	help       string
+	label      string
+	buckets    []float64
+	lock       sync.Mutex
+	// values by label value; key is "" if there is no label
+	values map[string]*histogramValues
+}
+
+// NewHistogram Create and register a histogram
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return r.NewHistogramWithLabel(name, help, "", buckets)
+}
+
+// NewHistogramWithLabel Create and register a histogram, with values kept separately for each value of a label
+func (r *Registry) NewHistogramWithLabel(name string, help string, label string, buckets []float64) *Histogram {
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+	h := &Histogram{metricName: name, help: help, label: label, buckets: sortedBuckets, values: map[string]*histogramValues{}}
+	if len(label) == 0 {
+		// without label, export zero values right away
+		h.values[""] = &histogramValues{counts: make([]uint64, len(h.buckets))}
+	}
+	r.register(h)
+	return h
+}
+
+// Observe Record a value
+func (h *Histogram) Observe(v float64) { h.ObserveWithLabel("", v) }
+
+// ObserveWithLabel Record a value, for the given label value
+func (h *Histogram) ObserveWithLabel(labelValue string, v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	vals, ok := h.values[labelValue]
+	if !ok {
+		vals = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[labelValue] = vals
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			vals.counts[i]++
+		}
+	}
+	vals.sum += v
+	vals.count++
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.metricName, h.help, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	labelValues := make([]string, 0, len(h.values))
+	for lv := range h.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		vals := h.values[lv]
+		labels := ""
+		if len(h.label) > 0 {
+			labels = h.label + "=" + strconv.Quote(lv) + ","
+		}
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%v_bucket{%vle=\"%v\"} %v\n", h.metricName, labels, formatFloat(upper), vals.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket{%vle=\"+Inf\"} %v\n", h.metricName, labels, vals.count)
+		labelsOnly := ""
+		if len(labels) > 0 {
+			labelsOnly = "{" + labels[:len(labels)-1] + "}"
+		}
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.metricName, labelsOnly, formatFloat(vals.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.metricName, labelsOnly, vals.count)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, metricType)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteAll Write all registered metrics, in the Prometheus text format, ordered by name
+func (r *Registry) WriteAll(w io.Writer) {
+	r.lock.Lock()
+	all := append([]metric{}, r.metrics...)
+	r.lock.Unlock()
+	sort.SliceStable(all, func(i, j int) bool { return all[i].name() < all[j].name() })
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+// Handler HTTP handler serving all registered metrics, for the /metrics endpoint
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteAll(w)
+	})
+}
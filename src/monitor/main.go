@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -58,11 +59,13 @@ func (s *CumulStats) ToString() string {
 		float32(s.DurationTotal.Milliseconds())/float32(s.Count))
 }
 
+var client *rpcclient.Client
+
 // Return success, duration
 func getWork(hash string) (bool, time.Duration) {
 	log.Printf("Requesting work from node, hash %v \n", hash)
 	// trigger work
-	resp, err, duration := rpcclient.GetWork(hash, 0)
+	resp, err, duration := client.GetWork(context.Background(), hash, 0)
 	if err != nil {
 		log.Printf("Work resp from node FAIL, dur %v, err %v \n", duration, err)
 		return false, duration
@@ -79,7 +82,7 @@ func pregenerate(hash string) {
 	action := "work_pregenerate_by_hash"
 	body := "{\"action\":\"" + action + "\", \"hash\": \"" + hash + "\"}"
 	log.Printf("Pregenerating for hash %v \n", hash)
-	rpcclient.MakeGenericCall(body)
+	client.MakeGenericCall(context.Background(), body)
 }
 
 // Do a simulated account cycle:
@@ -133,7 +136,7 @@ func getRandomHash() string {
 }
 
 func main() {
-	rpcclient.Init(nodeUrl, nodeUrl)
+	client = rpcclient.NewClient(nodeUrl, nodeUrl)
 
 	nextCheck := time.Now()
 	var cumulative CumulStats = CumulStats{}
@@ -3,13 +3,14 @@
 package restapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
-	"github.com/catenocrypt/nano-work-cache/rpcclient"
 	"github.com/catenocrypt/nano-work-cache/workcache"
 )
 
@@ -23,6 +24,34 @@ type workGenerateJson struct {
 	Difficulty string
 }
 
+type workGenerateBatchItemJson struct {
+	Hash       string
+	Difficulty string
+}
+
+type workGenerateBatchJson struct {
+	Action string
+	Items  []workGenerateBatchItemJson
+	// optional deadline, in milliseconds
+	Timeout string
+	// if "true", results available at the deadline are returned, the others are marked pending
+	Partial string
+}
+
+// Max number of items in a work_generate_batch request
+const maxBatchItems = 1000
+
+type workWaitJson struct {
+	Action     string
+	Hash       string
+	Difficulty string
+	// optional, in milliseconds
+	Timeout string
+}
+
+// Max time a work_wait request may wait
+const maxWorkWaitTimeout = 5 * time.Minute
+
 type workPregenerateByHashJson struct {
 	Action string
 	Hash   string
@@ -43,26 +72,147 @@ type accountsBalancesJson struct {
 	Accounts []string
 }
 
+// requestWithBlockJson Request with a block (process, block_hash), or with the fields of a block (block_create)
 type requestWithBlockJson struct {
-	Block blockJson
+	Account string
+	// block as JSON object, or as string containing the JSON (json_block false)
+	Block json.RawMessage
 }
 
+// responseWithHashJson Response with the hash of a block, and for block_create the block itself
 type responseWithHashJson struct {
-	Hash string
+	Hash  string
+	Block json.RawMessage
+}
+
+// blockAccount Extract the account from a block, given as JSON object or as string containing the JSON; empty if not found
+func blockAccount(block json.RawMessage) string {
+	if len(block) == 0 {
+		return ""
+	}
+	if block[0] == '"' {
+		var blockString string
+		if err := json.Unmarshal(block, &blockString); err != nil {
+			return ""
+		}
+		block = json.RawMessage(blockString)
+	}
+	var b blockJson
+	if err := json.Unmarshal(block, &b); err != nil {
+		return ""
+	}
+	return b.Account
+}
+
+// workResponseJson Response of work_generate, as by the node, extended with source.  Difficulty is in hex.
+type workResponseJson struct {
+	Hash       string `json:"hash"`
+	Work       string `json:"work"`
+	Difficulty string `json:"difficulty"`
+	Multiplier string `json:"multiplier"`
+	Source     string `json:"source"`
 }
 
-var enablePregeneration int = 1
+// pregenerateResponseJson Response of the pregenerate actions; account is echoed back for work_pregenerate_by_account
+type pregenerateResponseJson struct {
+	Account string `json:"account,omitempty"`
+	Hash    string `json:"hash"`
+	Source  string `json:"source"`
+}
 
-/// Not the normal Json Encode way, due to the difficulty hex formatting.  Using simple string concatenation.
-func workResponseToJson(resp workcache.WorkResponse) string {
-	return fmt.Sprintf(`{"hash":"%v","work":"%v","difficulty":"%x","multiplier":"%v","source":"%v"}`,
-		resp.Hash, resp.Work, resp.Difficulty, resp.Multiplier, resp.Source)
+func newWorkResponseJson(resp workcache.WorkResponse) workResponseJson {
+	return workResponseJson{resp.Hash, resp.Work, strconv.FormatUint(resp.Difficulty, 16), fmt.Sprint(resp.Multiplier), resp.Source}
+}
+
+// batchItemResponseJson Result of an item of work_generate_batch: the fields of work_generate, or an error
+type batchItemResponseJson struct {
+	Hash       string `json:"hash"`
+	Work       string `json:"work,omitempty"`
+	Difficulty string `json:"difficulty,omitempty"`
+	Multiplier string `json:"multiplier,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ErrorCode  string `json:"error_code,omitempty"`
+}
+
+type batchResponseJson struct {
+	Items []batchItemResponseJson `json:"items"`
+}
+
+func newBatchItemErrorJson(hash string, code string, message string) batchItemResponseJson {
+	return batchItemResponseJson{Hash: hash, Error: message, ErrorCode: code}
+}
+
+// handleGenerateBatch Handle work_generate_batch: items with invalid parameters get an error, the others are generated together
+func (s *Server) handleGenerateBatch(ctx context.Context, reqBody []byte, w http.ResponseWriter) {
+	var batchReq workGenerateBatchJson
+	err := json.Unmarshal(reqBody, &batchReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_generate_batch parse error", "")
+		return
+	}
+	if len(batchReq.Items) == 0 || len(batchReq.Items) > maxBatchItems {
+		writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_generate_batch needs 1 to "+strconv.Itoa(maxBatchItems)+" items", "")
+		return
+	}
+	partial := batchReq.Partial == "true"
+	if len(batchReq.Timeout) > 0 {
+		timeoutMs, err := strconv.ParseUint(batchReq.Timeout, 10, 32)
+		if err != nil || timeoutMs == 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_generate_batch timeout parse error", "")
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	log.Println("work_generate_batch req, items", len(batchReq.Items), "timeout", batchReq.Timeout, "partial", partial)
+
+	results := make([]batchItemResponseJson, len(batchReq.Items))
+	var items []workcache.BatchItem
+	// index of the valid items in the request
+	var itemIndices []int
+	for i, item := range batchReq.Items {
+		if !workcache.IsHashValid(item.Hash) {
+			results[i] = newBatchItemErrorJson(item.Hash, ErrCodeBadRequest, "Bad block hash number")
+			continue
+		}
+		var difficulty uint64 = 0
+		if len(item.Difficulty) > 0 {
+			difficulty, err = strconv.ParseUint(item.Difficulty, 16, 64)
+			if err != nil {
+				results[i] = newBatchItemErrorJson(item.Hash, ErrCodeBadRequest, "difficulty parse error")
+				continue
+			}
+		}
+		items = append(items, workcache.BatchItem{Hash: item.Hash, Difficulty: difficulty})
+		itemIndices = append(itemIndices, i)
+	}
+
+	if len(items) > 0 {
+		workResps, err := s.service.GenerateBatch(ctx, items, partial)
+		if err != nil {
+			writeErrorFromErr(w, err.Error(), err, "")
+			return
+		}
+		for j, resp := range workResps {
+			i := itemIndices[j]
+			if resp.Error != nil {
+				_, code := classifyError(resp.Error)
+				results[i] = newBatchItemErrorJson(items[j].Hash, code, resp.Error.Error())
+				continue
+			}
+			r := newWorkResponseJson(resp)
+			results[i] = batchItemResponseJson{Hash: r.Hash, Work: r.Work, Difficulty: r.Difficulty, Multiplier: r.Multiplier, Source: r.Source}
+		}
+	}
+	writeJson(w, http.StatusOK, batchResponseJson{results})
 }
 
 /// Proxy an incoming call to the node unmodified
-func proxyCall(action string, req string) (string, error) {
+func (s *Server) proxyCall(ctx context.Context, action string, req string) (string, error) {
 	//log.Println("transparent proxying of action", action)
-	respJSON, err := rpcclient.MakeGenericCall(req)
+	respJSON, err := s.client.MakeGenericCall(ctx, req)
 	if err != nil {
 		log.Println("RPC error:", err.Error())
 		return "", err
@@ -70,143 +220,192 @@ func proxyCall(action string, req string) (string, error) {
 	return respJSON, nil
 }
 
-func handleReqSync(action string, reqBody []byte, w http.ResponseWriter) {
+// proxyAndRespond Proxy an incoming call to the node unmodified, and write its response.  Returns the response, empty on error.
+func (s *Server) proxyAndRespond(ctx context.Context, action string, reqBody []byte, w http.ResponseWriter) string {
+	respJSON, err := s.proxyCall(ctx, action, string(reqBody))
+	if err != nil {
+		writeErrorFromErr(w, "RPC error: "+err.Error(), err, action)
+		return ""
+	}
+	writeRawJson(w, respJSON)
+	return respJSON
+}
+
+func (s *Server) handleReqSync(ctx context.Context, action string, reqBody []byte, w http.ResponseWriter) {
 	switch action {
 	case "work_generate":
 		var workGenerate workGenerateJson
 		err := json.Unmarshal(reqBody, &workGenerate)
 		if err != nil {
-			fmt.Fprintln(w, `{"error":"work_generate parse error"}`)
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_generate parse error", "")
 			return
 		}
 		log.Println("work_generate req", workGenerate)
-		var difficulty uint64 = rpcclient.GetDifficultyCached()
+		if !workcache.IsHashValid(workGenerate.Hash) {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Bad block hash number", "")
+			return
+		}
+		var difficulty uint64 = s.client.GetDifficultyCached(ctx)
 		if len(workGenerate.Difficulty) > 0 {
 			difficultyParsed, err := strconv.ParseUint(workGenerate.Difficulty, 16, 64)
 			if err != nil {
 				// diff present, but could not parse
-				fmt.Fprintln(w, `{"error":"work_generate difficulty parse error"}`)
+				writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_generate difficulty parse error", "")
 				return
 			}
 			difficulty = difficultyParsed
 		}
 		// handle
-		workResp, err := workcache.Generate(workGenerate.Hash, difficulty, "")
+		workResp, err := s.service.Generate(ctx, workGenerate.Hash, difficulty, "")
 		log.Println("work_generate resp", workResp)
 		if err != nil {
-			fmt.Fprintf(w, `{"error": "%v"}`, err.Error())
+			writeErrorFromErr(w, err.Error(), err, "")
+			return
+		}
+		writeJson(w, http.StatusOK, newWorkResponseJson(workResp))
+
+	case "work_generate_batch":
+		s.handleGenerateBatch(ctx, reqBody, w)
+
+	case "work_wait":
+		// wait for work to appear in the cache, e.g. after work_pregenerate_by_hash; does not start computation
+		var workWait workWaitJson
+		err := json.Unmarshal(reqBody, &workWait)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_wait parse error", "")
+			return
+		}
+		log.Println("work_wait req", workWait)
+		if !workcache.IsHashValid(workWait.Hash) {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Bad block hash number", "")
+			return
+		}
+		var difficulty uint64 = 0
+		if len(workWait.Difficulty) > 0 {
+			difficulty, err = strconv.ParseUint(workWait.Difficulty, 16, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_wait difficulty parse error", "")
+				return
+			}
+		}
+		// 0: default of the service
+		var timeout time.Duration = 0
+		if len(workWait.Timeout) > 0 {
+			timeoutMs, err := strconv.ParseUint(workWait.Timeout, 10, 32)
+			if err != nil || timeoutMs == 0 {
+				writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_wait timeout parse error", "")
+				return
+			}
+			timeout = time.Duration(timeoutMs) * time.Millisecond
+		}
+		if timeout > maxWorkWaitTimeout {
+			timeout = maxWorkWaitTimeout
+		}
+		workResp, err := s.service.WaitForWork(ctx, workWait.Hash, difficulty, timeout)
+		if err != nil {
+			writeErrorFromErr(w, err.Error(), err, "")
 			return
 		}
-		fmt.Fprintln(w, workResponseToJson(workResp))
-		break
+		writeJson(w, http.StatusOK, newWorkResponseJson(workResp))
 
 	case "work_pregenerate_by_hash":
 		var workPregenerateByHash workPregenerateByHashJson
 		err := json.Unmarshal(reqBody, &workPregenerateByHash)
 		if err != nil {
-			fmt.Fprintln(w, `{"error":"work_pregenerate_by_hash parse error"}`)
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_pregenerate_by_hash parse error", "")
 			return
 		}
 		log.Println("work_pregenerate_by_hash req", workPregenerateByHash)
 		var hash = workPregenerateByHash.Hash
+		if !workcache.IsHashValid(hash) {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Bad block hash number", "")
+			return
+		}
 		// start pregenerate asynchronously, regardless of enable flag
-		workcache.PregenerateByHash(hash, "")
+		s.service.PregenerateByHash(hash, "")
 		// return response, only hash
-		fmt.Fprintln(w, fmt.Sprintf(`{"hash":"%v","source":"started_in_background"}`, hash))
-		return
+		writeJson(w, http.StatusOK, pregenerateResponseJson{Hash: hash, Source: "started_in_background"})
 
 	case "work_pregenerate_by_account":
 		var workPregenerateByAccount workPregenerateByAccountJson
 		err := json.Unmarshal(reqBody, &workPregenerateByAccount)
 		if err != nil {
-			fmt.Fprintln(w, `{"error":"work_pregenerate_by_account parse error"}`)
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "work_pregenerate_by_account parse error", "")
 			return
 		}
 		log.Println("work_pregenerate_by_account req", workPregenerateByAccount)
 		var account = workPregenerateByAccount.Account
-		// get frontier of account
-		hash, err := workcache.GetFrontierHash(account)
+		if !workcache.IsAccountValid(account) {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Bad account number", "")
+			return
+		}
+		// get frontier of account; unknown account is also a bad request, other errors are of the node
+		hash, err := s.service.GetFrontierHash(ctx, account)
 		if err != nil {
-			fmt.Fprintln(w, fmt.Sprintf(`{"error":"%v"}`, err.Error()))
+			writeErrorFromErr(w, err.Error(), err, "")
 			return
 		}
 		// pregenerate work asynchronously, regardless of enable flag
-		workcache.PregenerateByHash(hash, account)
+		s.service.PregenerateByHash(hash, account)
 		// return response; account is echoed back; hash is returned; work is not available yet
-		fmt.Fprintln(w, fmt.Sprintf(`{"account":"%v","hash":"%v","source":"started_in_background"}`, account, hash))
-		return
+		writeJson(w, http.StatusOK, pregenerateResponseJson{account, hash, "started_in_background"})
 
 	case "account_balance":
 		// account_balance also triggers work_precompute in the background, and transparently proxies the call for balance
 		var accountBalance accountBalanceJson
 		err := json.Unmarshal(reqBody, &accountBalance)
 		if err != nil {
-			fmt.Fprintln(w, `{"error":"account_balance parse error"}`)
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "account_balance parse error", "")
 			return
 		}
 		//log.Println("account_balance", accountBalance)
 
-		if enablePregeneration >= 1 {
+		if s.opts.EnablePregeneration {
 			// get frontier and pregenerate work asynchronously
-			workcache.PregenerateByAccount(accountBalance.Account)
+			s.service.PregenerateByAccount(ctx, accountBalance.Account)
 		}
 
 		// proxy the call
-		respJSON, err := proxyCall(action, string(reqBody))
-		if err != nil {
-			fmt.Fprintln(w, `{"error":"RPC error: `+err.Error()+`","action":"`+action+`"}`)
-			return
-		}
-		fmt.Fprintln(w, respJSON)
-		break
+		s.proxyAndRespond(ctx, action, reqBody, w)
 
 	case "accounts_balances":
 		// accounts_balances also triggers work_precompute (for all accounts) in the background, and transparently proxies the call for balances
 		var accountsBalances accountsBalancesJson
 		err := json.Unmarshal(reqBody, &accountsBalances)
 		if err != nil {
-			fmt.Fprintln(w, `{"error":"accounts_balances parse error"}`)
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "accounts_balances parse error", "")
 			return
 		}
 		//log.Println("accounts_balances", accountsBalances)
 
-		if enablePregeneration >= 1 {
+		if s.opts.EnablePregeneration {
 			// for all accounts get frontier and pregenerate work asynchronously
 			for _, account := range accountsBalances.Accounts {
-				workcache.PregenerateByAccount(account)
+				s.service.PregenerateByAccount(ctx, account)
 			}
 		}
 
 		// proxy the call
-		respJSON, err := proxyCall(action, string(reqBody))
-		if err != nil {
-			fmt.Fprintln(w, `{"error":"RPC error: `+err.Error()+`","action":"`+action+`"}`)
-			return
-		}
-		fmt.Fprintln(w, respJSON)
-		break
+		s.proxyAndRespond(ctx, action, reqBody, w)
 
 	case "nano-work-cache-status-internal":
-		status := getStatus()
-		fmt.Fprintln(w, status)
-		break
+		writeJson(w, http.StatusOK, s.getStatus())
 
-	case "block_create":
-	case "block_hash":
-	case "process":
+	case "block_create", "block_hash", "process":
 		// proxy these calls unmodified, but watch the hash in the result, and trigger work computation for it in the background
-		// first try to obtain account from the request
+		// first try to obtain account from the request: from the block, or for block_create from the request itself
 		var account string = ""
 		var requestWithBlock requestWithBlockJson
 		err := json.Unmarshal(reqBody, &requestWithBlock)
 		if err == nil {
-			account = requestWithBlock.Block.Account
-			log.Println("Extracted account from request action", action, "account", account)
+			account = blockAccount(requestWithBlock.Block)
+			if len(account) == 0 {
+				account = requestWithBlock.Account
+			}
 		}
 
-		respJSON, err := proxyCall(action, string(reqBody))
-		if err != nil {
-			fmt.Fprintln(w, `{"error":"RPC error: `+err.Error()+`","action":"`+action+`"}`)
+		respJSON := s.proxyAndRespond(ctx, action, reqBody, w)
+		if len(respJSON) == 0 {
 			return
 		}
 
@@ -214,30 +413,28 @@ func handleReqSync(action string, reqBody []byte, w http.ResponseWriter) {
 		var responseWithHash responseWithHashJson
 		err = json.Unmarshal([]byte(respJSON), &responseWithHash)
 		if err != nil {
-			log.Println("Warning: Error reading hash from response of" + action)
-		} else {
-			if enablePregeneration >= 1 {
-				// we have the hash, trigger work computation
-				hash := responseWithHash.Hash
-				if len(hash) > 0 {
-					log.Println("Reqesting work from action", action, "for hash", hash, "and account", account)
-					workcache.PregenerateByHash(hash, account)
-				}
+			log.Println("Warning: Error reading hash from response of " + action)
+			return
+		}
+		if len(account) == 0 {
+			// block_create returns the created block
+			account = blockAccount(responseWithHash.Block)
+		}
+		if s.opts.EnablePregeneration {
+			// we have the hash, trigger work computation
+			hash := responseWithHash.Hash
+			if len(hash) > 0 {
+				log.Println("Reqesting work from action", action, "for hash", hash, "and account", account)
+				s.service.PregenerateByHash(hash, account)
 			}
 		}
-		fmt.Fprintln(w, respJSON)
 
 	case "stop":
 		log.Println("'" + action + "' message received, ignoring")
-		fmt.Fprintln(w, `{"success":"`+action+`"}`)
+		writeJson(w, http.StatusOK, map[string]string{"success": action})
 
 	default:
 		// proxy any other request unmodified
-		respJSON, err := proxyCall(action, string(reqBody))
-		if err != nil {
-			fmt.Fprintln(w, `{"error":"RPC error: `+err.Error()+`","action":"`+action+`"}`)
-			return
-		}
-		fmt.Fprintln(w, respJSON)
+		s.proxyAndRespond(ctx, action, reqBody, w)
 	}
 }
@@ -0,0 +1,376 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+	"github.com/catenocrypt/nano-work-cache/workcache"
+)
+
+func TestMain(m *testing.M) {
+	// the handlers log each request
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer Create a started service with the given options, and a server for it, using the fake node.  The service has to be stopped at the end.
+func newTestServer(t *testing.T, node *httptest.Server, serviceOpts workcache.Options, opts Options) (*Server, *workcache.Service) {
+	client := rpcclient.NewClient(node.URL, node.URL)
+	client.SetTimeouts(5*time.Second, 5*time.Second)
+	serviceOpts.Client = client
+	service, err := workcache.NewService(serviceOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(service, opts), service
+}
+
+// postRequest Send a request to the handler, return the status and the body
+func postRequest(handler http.Handler, body string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	return w.Code, w.Body.String()
+}
+
+func testHash(i int) string {
+	return fmt.Sprintf("%064X", i)
+}
+
+func TestWorkGenerateParallel(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"error":"not expected"}`)
+	}))
+	defer node.Close()
+	server, service := newTestServer(t, node, workcache.Options{
+		WorkSources: []workcache.WorkSourceConfig{{Type: workcache.WorkSourceTypeCpu, Threads: 1, TimeoutSec: 10}},
+	}, Options{})
+	defer service.Stop()
+	handler := server.Handler()
+
+	// several requests for each hash, some of them wait for the computation of others
+	const hashCount = 20
+	const requestsPerHash = 5
+	var wg sync.WaitGroup
+	errs := make(chan string, hashCount*requestsPerHash)
+	for i := 0; i < hashCount*requestsPerHash; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hash := testHash(i % hashCount)
+			status, body := postRequest(handler, `{"action":"work_generate","hash":"`+hash+`","difficulty":"1"}`)
+			if status != http.StatusOK {
+				errs <- fmt.Sprintf("status %v body %v", status, body)
+				return
+			}
+			var resp workResponseJson
+			if err := json.Unmarshal([]byte(body), &resp); err != nil {
+				errs <- err.Error()
+				return
+			}
+			if resp.Hash != hash {
+				errs <- "hash mismatch " + resp.Hash
+				return
+			}
+			if _, err := workcache.ValidateWork(hash, resp.Work, 1); err != nil {
+				errs <- "invalid work " + err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+}
+
+func TestServerStopConcurrent(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer node.Close()
+	server, service := newTestServer(t, node, workcache.Options{}, Options{ListenIpPort: "127.0.0.1:0"})
+	defer service.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// stop on ctx done, and explicitly at the same time
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); cancel() }()
+	go func() { defer wg.Done(); server.Stop() }()
+	wg.Wait()
+	server.Stop()
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+// fakeNode A node RPC for the tests: active_difficulty and work_generate are answered,
+// other calls get the configured response, and their request is recorded
+type fakeNode struct {
+	lock        sync.Mutex
+	response    string
+	lastRequest string
+}
+
+func (n *fakeNode) setResponse(response string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.response = response
+	n.lastRequest = ""
+}
+
+func (n *fakeNode) getLastRequest() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.lastRequest
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var action actionJson
+	json.Unmarshal(body, &action)
+	switch action.Action {
+	case "active_difficulty":
+		fmt.Fprint(w, `{"network_minimum":"0000000000000001","network_current":"0000000000000001","multiplier":"1"}`)
+	case "work_generate":
+		fmt.Fprint(w, `{"work":"0000000000000001","difficulty":"0000000000000001","multiplier":"1"}`)
+	default:
+		n.lock.Lock()
+		n.lastRequest = string(body)
+		response := n.response
+		n.lock.Unlock()
+		fmt.Fprint(w, response)
+	}
+}
+
+func TestBlockActionsProxiedAndPregenerated(t *testing.T) {
+	fake := &fakeNode{}
+	node := httptest.NewServer(fake)
+	defer node.Close()
+	server, service := newTestServer(t, node, workcache.Options{
+		WorkSources: []workcache.WorkSourceConfig{{Type: workcache.WorkSourceTypeNode, Url: node.URL, TimeoutSec: 5}},
+	}, Options{EnablePregeneration: true})
+	defer service.Stop()
+	handler := server.Handler()
+
+	// pregenerations show up as work results
+	events := make(chan workcache.WorkEvent, 10)
+	removeListener := service.AddWorkListener(func(e workcache.WorkEvent) { events <- e })
+	defer removeListener()
+
+	tests := []struct {
+		name     string
+		request  string
+		nodeResp string
+		// expected pregeneration, empty hash if none
+		hash    string
+		account string
+	}{
+		{
+			"block_create, block object",
+			`{"action":"block_create","json_block":"true","type":"state","account":"nano_1acc","previous":"` + testHash(10) + `","key":"K"}`,
+			`{"hash":"` + testHash(1) + `","difficulty":"fffffff800000000","block":{"type":"state","account":"nano_1acc","previous":"` + testHash(10) + `"}}`,
+			testHash(1), "nano_1acc",
+		},
+		{
+			"block_create, json_block false, account from the returned block",
+			`{"action":"block_create","type":"state","previous":"` + testHash(11) + `","key":"K"}`,
+			`{"hash":"` + testHash(2) + `","difficulty":"fffffff800000000","block":"{\n    \"type\": \"state\",\n    \"account\": \"nano_2acc\"\n}\n"}`,
+			testHash(2), "nano_2acc",
+		},
+		{
+			"block_hash",
+			`{"action":"block_hash","json_block":"true","block":{"type":"state","account":"nano_3acc","previous":"` + testHash(12) + `"}}`,
+			`{"hash":"` + testHash(3) + `"}`,
+			testHash(3), "nano_3acc",
+		},
+		{
+			"process, stringified block",
+			`{"action":"process","subtype":"send","block":"{\"type\":\"state\",\"account\":\"nano_4acc\",\"previous\":\"` + testHash(13) + `\"}"}`,
+			`{"hash":"` + testHash(4) + `"}`,
+			testHash(4), "nano_4acc",
+		},
+		{
+			"node error",
+			`{"action":"process","json_block":"true","block":{"type":"state","account":"nano_5acc"}}`,
+			`{"error":"Block is invalid"}`,
+			"", "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.setResponse(tt.nodeResp)
+			status, body := postRequest(handler, tt.request)
+			if status != http.StatusOK {
+				t.Errorf("status %v", status)
+			}
+			if strings.TrimSpace(body) != tt.nodeResp {
+				t.Errorf("response not proxied unmodified: %v", body)
+			}
+			if fake.getLastRequest() != tt.request {
+				t.Errorf("request not proxied unmodified: %v", fake.getLastRequest())
+			}
+			if len(tt.hash) == 0 {
+				select {
+				case e := <-events:
+					t.Errorf("unexpected pregeneration, hash %v", e.Hash)
+				case <-time.After(200 * time.Millisecond):
+				}
+				return
+			}
+			select {
+			case e := <-events:
+				if e.Hash != tt.hash || e.Account != tt.account {
+					t.Errorf("pregenerated hash %v account %v, expected %v %v", e.Hash, e.Account, tt.hash, tt.account)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("no pregeneration")
+			}
+		})
+	}
+}
+
+func TestOverloadNotNotified(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	fake := &fakeNode{}
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"work_generate"`) {
+			r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			fake.ServeHTTP(w, r)
+			return
+		}
+		// work_generate is held until released, using the only slot
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"work":"0000000000000001","difficulty":"0000000000000001","multiplier":"1"}`)
+	}))
+	defer node.Close()
+	server, service := newTestServer(t, node, workcache.Options{
+		WorkSources:    []workcache.WorkSourceConfig{{Type: workcache.WorkSourceTypeNode, Url: node.URL, TimeoutSec: 5}},
+		MaxOutRequests: 1,
+	}, Options{})
+	defer service.Stop()
+	handler := server.Handler()
+
+	// a websocket client subscribed to all results
+	c := &wsClient{send: make(chan interface{}, 10), closed: make(chan struct{}), sub: newWsSubscription(wsOptionsJson{})}
+	removeListener := service.AddWorkListener(c.onWork)
+	defer removeListener()
+
+	first := make(chan int, 1)
+	go func() {
+		status, _ := postRequest(handler, `{"action":"work_generate","hash":"`+testHash(1)+`","difficulty":"1"}`)
+		first <- status
+	}()
+	<-started
+	status, body := postRequest(handler, `{"action":"work_generate","hash":"`+testHash(2)+`","difficulty":"1"}`)
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, ErrCodeOverload) {
+		t.Errorf("status %v body %v, expected overload", status, body)
+	}
+	select {
+	case msg := <-c.send:
+		t.Errorf("notification on overload: %v", msg)
+	default:
+	}
+
+	close(release)
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("status %v", status)
+	}
+	select {
+	case msg := <-c.send:
+		work := msg.(wsMessageJson).Message.(wsWorkMessageJson)
+		if work.Success != "true" || work.Request.Hash != testHash(1) {
+			t.Errorf("unexpected notification %v", work)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no notification of the result")
+	}
+}
+
+func TestRequestMetricsByAction(t *testing.T) {
+	node := httptest.NewServer(&fakeNode{})
+	defer node.Close()
+	server, service := newTestServer(t, node, workcache.Options{}, Options{})
+	defer service.Stop()
+	handler := server.Handler()
+
+	tests := []struct {
+		action string
+		// expected label value
+		label string
+	}{
+		{"work_generate", "work_generate"},
+		{"work_generate_batch", "work_generate_batch"},
+		{"work_wait", "work_wait"},
+		{"no_such_action", "other"},
+	}
+	for _, tt := range tests {
+		// invalid requests are counted too
+		postRequest(handler, `{"action":"`+tt.action+`"}`)
+	}
+	var buf strings.Builder
+	service.Metrics().WriteAll(&buf)
+	for _, tt := range tests {
+		line := `nano_work_cache_request_duration_seconds_count{action="` + tt.label + `"} 1`
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("action %v not counted as %v", tt.action, tt.label)
+		}
+	}
+}
+
+func TestPregenerateByAccountErrors(t *testing.T) {
+	fake := &fakeNode{}
+	node := httptest.NewServer(fake)
+	defer node.Close()
+	server, service := newTestServer(t, node, workcache.Options{}, Options{})
+	defer service.Stop()
+	handler := server.Handler()
+
+	const account = "nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3"
+	tests := []struct {
+		name     string
+		account  string
+		nodeResp string
+		status   int
+		code     string
+	}{
+		// rejected before asking the node
+		{"invalid account", "nano_1invalid", `{"frontiers":{"nano_1invalid":"` + testHash(1) + `"}}`, http.StatusBadRequest, ErrCodeBadRequest},
+		{"unknown account", account, `{"frontiers":""}`, http.StatusBadRequest, ErrCodeBadRequest},
+		{"node error", account, `not json`, http.StatusBadGateway, ErrCodeUpstream},
+		{"ok", account, `{"frontiers":{"` + account + `":"` + testHash(1) + `"}}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.setResponse(tt.nodeResp)
+			status, body := postRequest(handler, `{"action":"work_pregenerate_by_account","account":"`+tt.account+`"}`)
+			if status != tt.status {
+				t.Errorf("status %v, expected %v; %v", status, tt.status, body)
+			}
+			if len(tt.code) > 0 && !strings.Contains(body, `"`+tt.code+`"`) {
+				t.Errorf("error code not %v; %v", tt.code, body)
+			}
+		})
+	}
+}
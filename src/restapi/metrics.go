@@ -0,0 +1,40 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package restapi
+
+import (
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/metrics"
+)
+
+// registerMetrics Add the metrics of the server to the registry (of the service)
+func (s *Server) registerMetrics(r *metrics.Registry) {
+	s.requestDuration = r.NewHistogramWithLabel("nano_work_cache_request_duration_seconds", "Duration of incoming requests, by action",
+		"action", metrics.DefaultDurationBuckets)
+	r.NewGaugeFunc("nano_work_cache_active_handlers", "Number of concurrently active request handlers",
+		func() float64 { return float64(s.ActiveHandlerCount()) })
+}
+
+// Actions with their own label value in request metrics; others are counted as "other", to limit label cardinality
+var metricActions = map[string]bool{
+	"work_generate":                   true,
+	"work_generate_batch":             true,
+	"work_wait":                       true,
+	"work_pregenerate_by_hash":        true,
+	"work_pregenerate_by_account":     true,
+	"account_balance":                 true,
+	"accounts_balances":               true,
+	"block_create":                    true,
+	"block_hash":                      true,
+	"process":                         true,
+	"nano-work-cache-status-internal": true,
+}
+
+// observeRequest Record the duration of a request
+func (s *Server) observeRequest(action string, startTime time.Time) {
+	if !metricActions[action] {
+		action = "other"
+	}
+	s.requestDuration.ObserveWithLabel(action, time.Now().Sub(startTime).Seconds())
+}
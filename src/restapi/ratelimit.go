@@ -3,36 +3,23 @@
 package restapi
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net/http"
 )
 
-var activeHandlerCount int = 0
-var maxActiveRequests int = 500
-
 // ActiveHandlerCount Return current number of conccurrent active handlers
-func ActiveHandlerCount() int { return activeHandlerCount }
-
-func incActiveCount() int {
-	activeHandlerCount++
-	return activeHandlerCount
-}
-func decActiveCount() int {
-	activeHandlerCount--
-	return activeHandlerCount
-}
+func (s *Server) ActiveHandlerCount() int { return s.handlerLimiter.Active() }
 
 // Handle incoming calls with rate limiting; if max is reached Overload error is returned
-func handleReqWithRateLimit(action string, respBody []byte, w http.ResponseWriter) {
-	incActiveCount()
-	defer decActiveCount()
-	if activeHandlerCount >= maxActiveRequests {
+func (s *Server) handleReqWithRateLimit(ctx context.Context, action string, respBody []byte, w http.ResponseWriter) {
+	if !s.handlerLimiter.TryAcquire() {
 		// overload, return error right away
-		log.Printf("Overload, %v active request handlers, max %v\n", activeHandlerCount, maxActiveRequests)
-		fmt.Fprintln(w, fmt.Sprintf(`{"error":"overload, too many concurrent active requests"}`))
+		log.Printf("Overload, %v active request handlers, max %v\n", s.handlerLimiter.Active(), s.handlerLimiter.Max())
+		writeError(w, http.StatusTooManyRequests, ErrCodeTooManyRequests, "overload, too many concurrent active requests", "")
 		return
 	}
+	defer s.handlerLimiter.Release()
 
-	handleReqSync(action, respBody, w)
+	s.handleReqSync(ctx, action, respBody, w)
 }
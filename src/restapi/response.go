@@ -0,0 +1,99 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+	"github.com/catenocrypt/nano-work-cache/workcache"
+)
+
+// Machine-readable error codes, in the error_code field of error responses
+const (
+	// ErrCodeBadRequest The request could not be parsed, or has invalid parameters (HTTP 400)
+	ErrCodeBadRequest = "bad_request"
+	// ErrCodeNotFound Unknown path (HTTP 404)
+	ErrCodeNotFound = "not_found"
+	// ErrCodeMethodNotAllowed Only POST is supported (HTTP 405)
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	// ErrCodeTooManyRequests Too many concurrent requests (HTTP 429)
+	ErrCodeTooManyRequests = "too_many_requests"
+	// ErrCodeOverload Too many outgoing work requests (HTTP 503)
+	ErrCodeOverload = "overload"
+	// ErrCodeUnavailable The service is stopped, or there is no work source (HTTP 503)
+	ErrCodeUnavailable = "unavailable"
+	// ErrCodeUpstream Error from the node or the work sources (HTTP 502)
+	ErrCodeUpstream = "upstream_error"
+	// ErrCodeTimeout Time limit exceeded, at the node or the work sources (HTTP 504)
+	ErrCodeTimeout = "timeout"
+	// ErrCodePending Work not ready by the deadline of a batch, still being computed (only for batch items)
+	ErrCodePending = "pending"
+)
+
+// errorResponseJson An error response; error is as in the node RPC, error_code is machine-readable
+type errorResponseJson struct {
+	Error     string `json:"error"`
+	ErrorCode string `json:"error_code"`
+	Action    string `json:"action,omitempty"`
+}
+
+// writeJson Write a response with the given HTTP status, the value encoded in JSON
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
+	if err != nil {
+		log.Println("WARNING", "Could not write response;", err.Error())
+	}
+}
+
+// writeRawJson Write a response which is JSON already (e.g. proxied from the node), with status 200
+func writeRawJson(w http.ResponseWriter, respJSON string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(respJSON))
+	if len(respJSON) == 0 || respJSON[len(respJSON)-1] != '\n' {
+		w.Write([]byte("\n"))
+	}
+}
+
+// writeError Write an error response, with the given HTTP status and error code
+func writeError(w http.ResponseWriter, status int, code string, message string, action string) {
+	writeJson(w, status, errorResponseJson{message, code, action})
+}
+
+// writeErrorFromErr Write an error response for an error of the service or of a call to the node,
+// with the HTTP status and error code derived from the error
+func writeErrorFromErr(w http.ResponseWriter, message string, err error, action string) {
+	status, code := classifyError(err)
+	writeError(w, status, code, message, action)
+}
+
+// classifyError Return the HTTP status and error code for an error of the service or of a call to the node
+func classifyError(err error) (int, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, rpcclient.ErrAccountNotFound):
+		return http.StatusBadRequest, ErrCodeBadRequest
+	case errors.Is(err, workcache.ErrServiceStopped), errors.Is(err, workcache.ErrNoWorkSource):
+		return http.StatusServiceUnavailable, ErrCodeUnavailable
+	case errors.Is(err, workcache.ErrWorkPending):
+		return http.StatusAccepted, ErrCodePending
+	case errors.Is(err, workcache.ErrOverload):
+		return http.StatusServiceUnavailable, ErrCodeOverload
+	case errors.Is(err, workcache.ErrWaitTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, ErrCodeTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, ErrCodeTimeout
+	default:
+		return http.StatusBadGateway, ErrCodeUpstream
+	}
+}
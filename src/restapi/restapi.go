@@ -3,12 +3,17 @@
 package restapi
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/catenocrypt/nano-work-cache/metrics"
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
 	"github.com/catenocrypt/nano-work-cache/workcache"
 )
 
@@ -16,27 +21,28 @@ type actionJson struct {
 	Action string
 }
 
-func handleRequest(w http.ResponseWriter, req *http.Request) {
+func (s *Server) handleRequest(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path != "/" {
-		http.Error(w, "404 not found.", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "404 not found.", "")
 		return
 	}
 
 	switch req.Method {
 	case "GET":
-		fmt.Fprintf(w, "GET not supported")
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "GET not supported", "")
 
 	case "POST":
 		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			fmt.Fprintln(w, `{"error":"could not read post data"}`)
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "could not read post data", "")
 		} else {
 			//decoder := json.NewDecoder(body)
 			var action actionJson
 			//err := decoder.Decode(&action)
 			err := json.Unmarshal(body, &action)
 			if err != nil {
-				fmt.Fprintln(w, `{"error":"action parse error"}`)
+				writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "action parse error", "")
 			} else {
 				//userAgent := req.Header["User-Agent"][0]
 				//if strings.HasPrefix(action.Action, "work_generate") {
@@ -44,22 +50,136 @@ func handleRequest(w http.ResponseWriter, req *http.Request) {
 				//	_ = json.Unmarshal(body, &workGenerate)
 				//	log.Println("header", userAgent, "remoteAddr", req.RemoteAddr, "action", action.Action, "diff", workGenerate.Difficulty)
 				//}
-				handleReqWithRateLimit(action.Action, body, w)
+				startTime := time.Now()
+				s.handleReqWithRateLimit(req.Context(), action.Action, body, w)
+				s.observeRequest(action.Action, startTime)
 			}
 		}
 
 	default:
-		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Sorry, only POST method is supported.", "")
 	}
 }
 
-func Start() {
-	listenIpPort := workcache.ConfigListenIpPort()
-	maxActiveRequests = workcache.ConfigRestMaxActiveRequests()
-	enablePregeneration = workcache.ConfigEnablePregeneration()
+// Options Settings of a Server
+type Options struct {
+	// Address to listen on, e.g. ":7176"
+	ListenIpPort string
+	// Max number of concurrently active request handlers; 0 means no limit
+	MaxActiveRequests int
+	// If set, work is pregenerated for accounts and blocks seen in proxied calls
+	EnablePregeneration bool
+	// Max time to wait for active requests to finish, at stop; default 10 s
+	ShutdownTimeout time.Duration
+	// If set, work result notifications are served on "/websocket"
+	EnableWebSocket bool
+}
+
+// Server The RPC-compatible HTTP API, in front of a work cache service
+type Server struct {
+	service         *workcache.Service
+	client          *rpcclient.Client
+	opts            Options
+	handlerLimiter  *workcache.Limiter
+	requestDuration *metrics.Histogram
+	startTime       time.Time
+	httpServer      *http.Server
+	listenAddr      string
+	started         bool
+	stopOnce        sync.Once
+	done            chan struct{}
+
+	// Connected websocket clients; closed at Stop
+	wsClients map[*wsClient]bool
+	wsClosing bool
+	wsLock    sync.Mutex
+}
+
+// NewServer Create a server for the given service.  It has to be started with Start.
+func NewServer(service *workcache.Service, opts Options) *Server {
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 10 * time.Second
+	}
+	s := &Server{
+		service:        service,
+		client:         service.Client(),
+		opts:           opts,
+		handlerLimiter: workcache.NewLimiter(opts.MaxActiveRequests),
+		startTime:      time.Now(),
+		done:           make(chan struct{}),
+		wsClients:      map[*wsClient]bool{},
+	}
+	s.registerMetrics(service.Metrics())
+	s.httpServer = &http.Server{Addr: opts.ListenIpPort, Handler: s.Handler()}
+	return s
+}
+
+// Handler Return the HTTP handler of the server, serving the API on "/", the metrics on "/metrics",
+// and the work notifications on "/websocket" (if enabled).
+// Can be used to serve the API from an existing HTTP server, instead of Start.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleRequest)
+	mux.Handle("/metrics", s.service.Metrics().Handler())
+	if s.opts.EnableWebSocket {
+		mux.HandleFunc("/websocket", s.handleWebSocket)
+	}
+	return mux
+}
 
-	http.HandleFunc("/", handleRequest)
+// Start Start listening and serving requests, in the background.  Returns error if it cannot listen.
+// The server stops when ctx is done, or on Stop.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.opts.ListenIpPort)
+	if err != nil {
+		return err
+	}
+	s.listenAddr = listener.Addr().String()
+	s.started = true
+	log.Println("Starting listening on", s.listenAddr, "...")
+	go func() {
+		defer close(s.done)
+		err := s.httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("WARNING", "HTTP server error;", err.Error())
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// Addr Return the address the server listens on (with the actual port, if port 0 was given); empty before Start
+func (s *Server) Addr() string { return s.listenAddr }
+
+// Done Return a channel which is closed when the server has stopped serving (after Stop, or on error)
+func (s *Server) Done() <-chan struct{} { return s.done }
 
-	log.Println("Starting listening on", listenIpPort, "...")
-	http.ListenAndServe(listenIpPort, nil)
+// Stop Stop accepting requests, wait for active requests to finish (at most ShutdownTimeout), then close all connections.
+// May be called several times, also concurrently (e.g. on ctx done and explicitly); all calls return when stopped.
+func (s *Server) Stop() {
+	if !s.started {
+		return
+	}
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Server) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+	// websocket connections are not tracked by the HTTP server
+	s.closeWsClients()
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		log.Println("WARNING", "Active requests did not finish in time, closing;", err.Error())
+		s.httpServer.Close()
+	}
+	<-s.done
+	log.Println("HTTP server stopped")
 }
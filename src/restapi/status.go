@@ -3,34 +3,63 @@
 package restapi
 
 import (
-	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/catenocrypt/nano-work-cache/rpcclient"
 	"github.com/catenocrypt/nano-work-cache/workcache"
 )
 
-var startTime time.Time = time.Now()
+// statusJson The inner status info of the service
+type statusJson struct {
+	CacheSize             int                        `json:"cache_size"`
+	CacheBytes            int64                      `json:"cache_bytes"`
+	CacheEvictedServed    int64                      `json:"cache_evicted_served"`
+	CacheEvictedStale     int64                      `json:"cache_evicted_stale"`
+	CacheEvictedLru       int64                      `json:"cache_evicted_lru"`
+	WorkInReqCount        int                        `json:"work_in_req_count"`
+	WorkInReqFromCache    int                        `json:"work_in_req_from_cache"`
+	WorkInReqError        int                        `json:"work_in_req_error"`
+	WorkInReqCacheRatio   float32                    `json:"work_in_req_cache_ratio"`
+	WorkOutReqCount       int                        `json:"work_out_req_count"`
+	WorkOutRespCount      int                        `json:"work_out_resp_count"`
+	WorkOutDurAvg         int                        `json:"work_out_dur_avg"`
+	ActiveHandlerCount    int                        `json:"active_handler_count"`
+	ActiveWorkOutReqCount int                        `json:"active_work_out_req_count"`
+	WebSocketClientCount  int                        `json:"websocket_client_count"`
+	PregenerQueSize       int                        `json:"pregenr_que_size"`
+	WorkPeers             []workcache.WorkPeerStatus `json:"work_peers"`
+	Diff                  string                     `json:"diff"`
+	Hrs                   float64                    `json:"hrs"`
+}
 
-// Return the inner status info of the service, in Json string
-func getStatus() string {
-	cacheSize := workcache.StatusCacheSize()
-	workOutReqCount := workcache.StatusWorkOutReqCount()
-	workOutRespCount := workcache.StatusWorkOutRespCount()
-	workOutDurAvg := workcache.StatusWorkOutDurationAvg()
-	workInReqCount := workcache.StatusWorkInReqCount()
-	workInReqFromCache := workcache.StatusWorkInReqFromCache()
-	workInReqError := workcache.StatusWorkInReqError()
+// Return the inner status info of the service
+func (s *Server) getStatus() statusJson {
+	workInReqCount := s.service.StatusWorkInReqCount()
+	workInReqFromCache := s.service.StatusWorkInReqFromCache()
 	var workInReqCacheRatio float32 = 0
 	if workInReqCount > 0 {
 		workInReqCacheRatio = float32(workInReqFromCache) / float32(workInReqCount)
 	}
-	activeHandlerCount := ActiveHandlerCount()
-	activeWorkOutReqCount := workcache.StatusActiveWorkOutReqCount()
-	pregenerQueSize := workcache.StatusPregenerQueueSize()
-	uptime := time.Now().Sub(startTime)
-	return fmt.Sprintf(`{"cache_size": %v, "work_in_req_count": %v, "work_in_req_from_cache": %v, "work_in_req_error": %v, "work_in_req_cache_ratio": %v, "work_out_req_count": %v, "work_out_resp_count": %v, "work_out_dur_avg": %v, "active_handler_count": %v, "active_work_out_req_count": %v, "pregenr_que_size": %v, "diff": "%v", "hrs": %v}`,
-		cacheSize, workInReqCount, workInReqFromCache, workInReqError, workInReqCacheRatio, workOutReqCount, workOutRespCount, workOutDurAvg, activeHandlerCount, activeWorkOutReqCount, pregenerQueSize,
-		strconv.FormatUint(rpcclient.GetDifficultyCached(), 16), uptime.Hours())
+	cacheEvictions := s.service.StatusCacheEvictions()
+	return statusJson{
+		CacheSize:             s.service.StatusCacheSize(),
+		CacheBytes:            s.service.StatusCacheBytes(),
+		CacheEvictedServed:    cacheEvictions.Served,
+		CacheEvictedStale:     cacheEvictions.StaleFrontier,
+		CacheEvictedLru:       cacheEvictions.LRU,
+		WorkInReqCount:        workInReqCount,
+		WorkInReqFromCache:    workInReqFromCache,
+		WorkInReqError:        s.service.StatusWorkInReqError(),
+		WorkInReqCacheRatio:   workInReqCacheRatio,
+		WorkOutReqCount:       s.service.StatusWorkOutReqCount(),
+		WorkOutRespCount:      s.service.StatusWorkOutRespCount(),
+		WorkOutDurAvg:         s.service.StatusWorkOutDurationAvg(),
+		ActiveHandlerCount:    s.ActiveHandlerCount(),
+		ActiveWorkOutReqCount: s.service.StatusActiveWorkOutReqCount(),
+		WebSocketClientCount:  s.wsClientCount(),
+		PregenerQueSize:       s.service.StatusPregenerQueueSize(),
+		WorkPeers:             s.service.StatusWorkPeers(),
+		Diff:                  strconv.FormatUint(s.client.GetDifficultyLast(), 16),
+		Hrs:                   time.Now().Sub(s.startTime).Hours(),
+	}
 }
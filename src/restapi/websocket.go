@@ -0,0 +1,310 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package restapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/workcache"
+	"github.com/gorilla/websocket"
+)
+
+// Topic of the work result notifications
+const wsTopicWork = "work"
+
+const (
+	// Max number of messages queued for sending to a client; further messages are dropped
+	wsSendQueueSize = 256
+	// Time limit for writing a message to a client
+	wsWriteTimeout = 10 * time.Second
+	// Max size of an incoming message
+	wsMaxMessageSize = 1 << 20
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// clients are not restricted by origin, as for the HTTP API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequestJson Incoming message, as in the node websocket: subscribe, update, unsubscribe, ping
+type wsRequestJson struct {
+	Action  string
+	Topic   string
+	Ack     bool
+	Id      string
+	Options wsOptionsJson
+}
+
+// wsOptionsJson Options of subscribe (hashes, accounts) and update (the add and del variants)
+type wsOptionsJson struct {
+	Hashes      []string
+	Accounts    []string
+	HashesAdd   []string `json:"hashes_add"`
+	HashesDel   []string `json:"hashes_del"`
+	AccountsAdd []string `json:"accounts_add"`
+	AccountsDel []string `json:"accounts_del"`
+}
+
+type wsAckJson struct {
+	Ack  string `json:"ack"`
+	Time string `json:"time"`
+	Id   string `json:"id,omitempty"`
+}
+
+type wsMessageJson struct {
+	Topic   string      `json:"topic"`
+	Time    string      `json:"time"`
+	Message interface{} `json:"message"`
+}
+
+// wsWorkRequestJson The hash (and account, if known) a work result is for
+type wsWorkRequestJson struct {
+	Hash    string `json:"hash"`
+	Account string `json:"account,omitempty"`
+}
+
+// wsWorkMessageJson A work result notification, similar to the work topic of the node; result is missing on error
+type wsWorkMessageJson struct {
+	Success  string            `json:"success"`
+	Reason   string            `json:"reason"`
+	Duration string            `json:"duration"`
+	Request  wsWorkRequestJson `json:"request"`
+	Result   *workResponseJson `json:"result,omitempty"`
+}
+
+// wsSubscription The hashes and accounts a client is interested in; if both are empty, all results are sent
+type wsSubscription struct {
+	hashes   map[string]bool
+	accounts map[string]bool
+}
+
+func newWsSubscription(options wsOptionsJson) *wsSubscription {
+	sub := &wsSubscription{hashes: map[string]bool{}, accounts: map[string]bool{}}
+	sub.update(options.Hashes, options.Accounts, nil, nil)
+	return sub
+}
+
+func (sub *wsSubscription) update(hashesAdd []string, accountsAdd []string, hashesDel []string, accountsDel []string) {
+	for _, h := range hashesAdd {
+		sub.hashes[h] = true
+	}
+	for _, a := range accountsAdd {
+		sub.accounts[a] = true
+	}
+	for _, h := range hashesDel {
+		delete(sub.hashes, h)
+	}
+	for _, a := range accountsDel {
+		delete(sub.accounts, a)
+	}
+}
+
+func (sub *wsSubscription) matches(event workcache.WorkEvent) bool {
+	if len(sub.hashes) == 0 && len(sub.accounts) == 0 {
+		return true
+	}
+	return sub.hashes[event.Hash] || (len(event.Account) > 0 && sub.accounts[event.Account])
+}
+
+// wsClient A websocket connection.  Messages are sent by a separate goroutine, from a queue.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan interface{}
+	// closed when the connection is closed
+	closed chan struct{}
+	// the subscription to the work topic, nil if not subscribed
+	sub  *wsSubscription
+	lock sync.Mutex
+}
+
+func wsTimeNow() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+}
+
+func newWsWorkMessage(event workcache.WorkEvent) wsWorkMessageJson {
+	msg := wsWorkMessageJson{
+		Success:  "true",
+		Duration: strconv.FormatInt(event.Duration.Milliseconds(), 10),
+		Request:  wsWorkRequestJson{event.Hash, event.Account},
+	}
+	if event.Error != nil {
+		msg.Success = "false"
+		msg.Reason = event.Error.Error()
+		return msg
+	}
+	result := newWorkResponseJson(workcache.WorkResponse{Hash: event.Hash, Work: event.Work, Difficulty: event.Difficulty, Multiplier: event.Multiplier, Source: "fresh"})
+	msg.Result = &result
+	return msg
+}
+
+// enqueue Queue a message for sending; dropped if the queue is full or the connection is closed
+func (c *wsClient) enqueue(msg interface{}) {
+	select {
+	case <-c.closed:
+	case c.send <- msg:
+	default:
+		log.Println("WARNING", "Websocket send queue full, dropping message;", c.conn.RemoteAddr())
+	}
+}
+
+// onWork Listener of work results, sends a notification if subscribed.  Errors that are not final for the hash
+// (overload, abandoned computation) are not sent, the work may still come.
+func (c *wsClient) onWork(event workcache.WorkEvent) {
+	if event.Error != nil && workcache.IsWaitableError(event.Error) {
+		return
+	}
+	c.lock.Lock()
+	matches := c.sub != nil && c.sub.matches(event)
+	c.lock.Unlock()
+	if matches {
+		c.enqueue(wsMessageJson{wsTopicWork, wsTimeNow(), newWsWorkMessage(event)})
+	}
+}
+
+// handleMessage Process an incoming message
+func (c *wsClient) handleMessage(data []byte) {
+	var req wsRequestJson
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		log.Println("WARNING", "Could not parse websocket message;", err.Error())
+		return
+	}
+	switch req.Action {
+	case "ping":
+		c.enqueue(wsAckJson{"pong", wsTimeNow(), req.Id})
+		return
+	case "subscribe", "update", "unsubscribe":
+		if req.Topic != wsTopicWork {
+			log.Println("WARNING", "Unknown websocket topic", req.Topic)
+			return
+		}
+	default:
+		log.Println("WARNING", "Unknown websocket action", req.Action)
+		return
+	}
+	c.lock.Lock()
+	switch req.Action {
+	case "subscribe":
+		c.sub = newWsSubscription(req.Options)
+	case "update":
+		if c.sub != nil {
+			c.sub.update(req.Options.HashesAdd, req.Options.AccountsAdd, req.Options.HashesDel, req.Options.AccountsDel)
+		}
+	case "unsubscribe":
+		c.sub = nil
+	}
+	c.lock.Unlock()
+	if req.Ack {
+		c.enqueue(wsAckJson{req.Action, wsTimeNow(), req.Id})
+	}
+}
+
+// writeLoop Send the queued messages, until the connection is closed
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err := c.writeJson(msg)
+			if err != nil {
+				log.Println("WARNING", "Websocket write error;", err.Error())
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// writeJson Send a message encoded in JSON, without HTML escaping, as the HTTP responses
+func (c *wsClient) writeJson(msg interface{}) error {
+	writer, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(msg)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// handleWebSocket Serve a websocket connection: clients subscribe to the work topic, for hashes or accounts,
+// and are notified of the work results.  The message format follows the node websocket.
+func (s *Server) handleWebSocket(w http.ResponseWriter, req *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// error response has been sent already
+		log.Println("WARNING", "Websocket upgrade error;", err.Error())
+		return
+	}
+	conn.SetReadLimit(wsMaxMessageSize)
+	c := &wsClient{conn: conn, send: make(chan interface{}, wsSendQueueSize), closed: make(chan struct{})}
+	if !s.addWsClient(c) {
+		conn.Close()
+		return
+	}
+	defer s.removeWsClient(c)
+	removeListener := s.service.AddWorkListener(c.onWork)
+	defer removeListener()
+	log.Println("Websocket client connected", conn.RemoteAddr())
+
+	go c.writeLoop()
+	defer close(c.closed)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("WARNING", "Websocket read error;", err.Error())
+			}
+			break
+		}
+		c.handleMessage(data)
+	}
+	conn.Close()
+	log.Println("Websocket client disconnected", conn.RemoteAddr())
+}
+
+// addWsClient Register a connection, to be closed at Stop; false if the server is stopping
+func (s *Server) addWsClient(c *wsClient) bool {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	if s.wsClosing {
+		return false
+	}
+	s.wsClients[c] = true
+	return true
+}
+
+func (s *Server) removeWsClient(c *wsClient) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	delete(s.wsClients, c)
+}
+
+// closeWsClients Close all websocket connections, their handlers exit
+func (s *Server) closeWsClients() {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	s.wsClosing = true
+	for c := range s.wsClients {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server stopping"), time.Now().Add(time.Second))
+		c.conn.Close()
+	}
+}
+
+// wsClientCount Number of connected websocket clients
+func (s *Server) wsClientCount() int {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	return len(s.wsClients)
+}
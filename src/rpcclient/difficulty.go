@@ -3,34 +3,47 @@
 package rpcclient
 
 import (
+	"context"
 	"strconv"
 	"time"
 )
 
-var difficulty uint64 = 0xffffffc000000000
-var diffTime time.Time = time.Now().Add(-100 * time.Hour)
+// Difficulty used until the actual one is retrieved
+const defaultDifficulty uint64 = 0xffffffc000000000
 
 const cacheExpiry time.Duration = 60 * time.Second
 
 // GetDifficultyCached Get the current network difficulty, comes from RPC, cached for some minutes
-func GetDifficultyCached() uint64 {
+func (c *Client) GetDifficultyCached(ctx context.Context) uint64 {
 	now := time.Now()
-	age := now.Sub(diffTime)
+	c.diffLock.Lock()
+	age := now.Sub(c.diffTime)
+	cached := c.difficulty
+	c.diffLock.Unlock()
 	//fmt.Printf("diff %v age %v \n", difficulty, age)
-	if difficulty > 0 && age <= cacheExpiry {
+	if cached > 0 && age <= cacheExpiry {
 		// valid and fresh, return cached
-		return difficulty
+		return cached
 	}
-	diffRpc, err := GetDifficulty()
+	diffRpc, err := c.GetDifficulty(ctx)
 	if err != nil {
-		return difficulty
+		return cached
 	}
 	difficultyParsed, err := strconv.ParseUint(diffRpc, 16, 64)
 	if err != nil {
-		return difficulty
+		return cached
 	}
 	// store it
-	difficulty = difficultyParsed
-	diffTime = now
-	return difficulty
+	c.diffLock.Lock()
+	c.difficulty = difficultyParsed
+	c.diffTime = now
+	c.diffLock.Unlock()
+	return difficultyParsed
+}
+
+// GetDifficultyLast Get the last known network difficulty, without calling the node
+func (c *Client) GetDifficultyLast() uint64 {
+	c.diffLock.Lock()
+	defer c.diffLock.Unlock()
+	return c.difficulty
 }
@@ -4,6 +4,7 @@ package rpcclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,6 +30,7 @@ type (
 		Work       string
 		Difficulty string
 		Multiplier string
+		Error      string
 	}
 
 	AccountFrontiersRespJson struct {
@@ -41,22 +44,63 @@ type (
 	}
 )
 
-var rpcUrl string = "?"
-var rpcWorkUrl string = "?"
+// Client Client of a node: URL for generic calls, URL for work, time limits, cached difficulty
+type Client struct {
+	rpcUrl     string
+	rpcWorkUrl string
+	// Time limit for generic RPC calls
+	rpcTimeout time.Duration
+	// Time limit for work_generate calls
+	workTimeout time.Duration
 
-func Init(rpcUrlIn string, rpcWorkUrlIn string) {
-	rpcUrl = rpcUrlIn
-	rpcWorkUrl = rpcWorkUrlIn
+	// cached network difficulty, see GetDifficultyCached
+	diffLock   sync.Mutex
+	difficulty uint64
+	diffTime   time.Time
 }
 
+// Time limit for calls through RpcCall
+const defaultTimeout time.Duration = 60 * time.Second
+
+// Shared client, keeps connections alive.  Time limits are applied per call, through the context.
+var httpClient *http.Client = &http.Client{}
+
+// NewClient Create a client for a node, with URL for generic calls, and URL for work calls (if empty, same as rpcUrl)
+func NewClient(rpcUrl string, rpcWorkUrl string) *Client {
+	if len(rpcWorkUrl) == 0 {
+		rpcWorkUrl = rpcUrl
+	}
+	return &Client{
+		rpcUrl:      rpcUrl,
+		rpcWorkUrl:  rpcWorkUrl,
+		rpcTimeout:  15 * time.Second,
+		workTimeout: 60 * time.Second,
+		difficulty:  defaultDifficulty,
+		diffTime:    time.Now().Add(-100 * time.Hour),
+	}
+}
+
+// SetTimeouts Set the time limits of generic RPC calls, and of work_generate calls
+func (c *Client) SetTimeouts(rpcTimeout time.Duration, workTimeout time.Duration) {
+	c.rpcTimeout = rpcTimeout
+	c.workTimeout = workTimeout
+}
+
+// RpcCall Make an RPC call to the URL, with a default time limit
 func RpcCall(url string, reqJson string) (respJson string, err error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(reqJson))
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return RpcCallContext(ctx, url, reqJson)
+}
+
+// RpcCallContext Make an RPC call, which can be cancelled (or time-limited) through the context
+func RpcCallContext(ctx context.Context, url string, reqJson string) (respJson string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBufferString(reqJson))
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -68,17 +112,35 @@ func RpcCall(url string, reqJson string) (respJson string, err error) {
 	return string(body), nil
 }
 
-// work_generate.  Difficulty may be missing (0)
-func GetWork(hash string, diff uint64) (WorkResponse, error, time.Duration) {
+// rpcCall Make an RPC call to the node, with the generic time limit
+func (c *Client) rpcCall(ctx context.Context, reqJson string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	return RpcCallContext(ctx, c.rpcUrl, reqJson)
+}
+
+// work_generate, on the work node, with its time limit.  Difficulty may be missing (0)
+func (c *Client) GetWork(ctx context.Context, hash string, diff uint64) (WorkResponse, error, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, c.workTimeout)
+	defer cancel()
+	return GetWorkFrom(ctx, c.rpcWorkUrl, hash, diff, true)
+}
+
+// GetWorkFrom work_generate from the given URL, a node or a work server.  Difficulty may be missing (0).
+// usePeers: if set, the node is asked to use its work peers (not supported by work servers).
+// Time limit is taken from ctx.
+func GetWorkFrom(ctx context.Context, url string, hash string, diff uint64, usePeers bool) (WorkResponse, error, time.Duration) {
 	timeStart := time.Now()
 	reqJson := fmt.Sprintf(`{"action":"work_generate","hash":"%v"`, hash)
-	reqJson += `,"use_peers":"true"`
+	if usePeers {
+		reqJson += `,"use_peers":"true"`
+	}
 	if diff != 0 {
 		reqJson += fmt.Sprintf(`,"difficulty":"%x"`, diff)
 	}
 	reqJson += `}`
-	log.Printf("Requesting work, from %v, %v \n", rpcWorkUrl, reqJson)
-	respString, err := RpcCall(rpcWorkUrl, reqJson)
+	log.Printf("Requesting work, from %v, %v \n", url, reqJson)
+	respString, err := RpcCallContext(ctx, url, reqJson)
 	var resp WorkResponse
 	if err != nil {
 		return resp, err, 0
@@ -89,6 +151,9 @@ func GetWork(hash string, diff uint64) (WorkResponse, error, time.Duration) {
 	if err != nil {
 		return resp, err, 0
 	}
+	if len(respStruct1.Error) > 0 {
+		return resp, errors.New("work_generate error from " + url + ": " + respStruct1.Error), 0
+	}
 	difficulty, err := strconv.ParseUint(respStruct1.Difficulty, 16, 64)
 	if err != nil {
 		// diff not present, take input (in reality actual difficulty is usually higher)
@@ -104,11 +169,30 @@ func GetWork(hash string, diff uint64) (WorkResponse, error, time.Duration) {
 	return resp, nil, timeStop.Sub(timeStart)
 }
 
+// CancelWorkAt work_cancel on the given node or work server: stop an ongoing work generation for the hash
+func CancelWorkAt(ctx context.Context, url string, hash string) error {
+	reqJson := fmt.Sprintf(`{"action":"work_cancel","hash":"%v"}`, hash)
+	log.Printf("Cancelling work, at %v, %v \n", url, reqJson)
+	respString, err := RpcCallContext(ctx, url, reqJson)
+	if err != nil {
+		return err
+	}
+	var respStruct1 struct{ Error string }
+	err = json.Unmarshal([]byte(respString), &respStruct1)
+	if err != nil {
+		return err
+	}
+	if len(respStruct1.Error) > 0 {
+		return errors.New("work_cancel error from " + url + ": " + respStruct1.Error)
+	}
+	return nil
+}
+
 // Get frontier blocks for accounts, accounts_frontiers
-func GetFrontiers(accounts []string) (map[string]string, error) {
+func (c *Client) GetFrontiers(ctx context.Context, accounts []string) (map[string]string, error) {
 	reqJson := `{"action":"accounts_frontiers","accounts":["` + strings.Join(accounts[:], `","`) + `"]}`
 	//fmt.Println(reqJson)
-	respString, err := RpcCall(rpcUrl, reqJson)
+	respString, err := c.rpcCall(ctx, reqJson)
 	if err != nil {
 		return nil, err
 	}
@@ -117,6 +201,11 @@ func GetFrontiers(accounts []string) (map[string]string, error) {
 	var respStruct1 AccountFrontiersRespJson
 	err = json.Unmarshal([]byte(respString), &respStruct1)
 	if err != nil {
+		// the node sends an empty string instead of an empty object, if none of the accounts is found
+		var respEmpty struct{ Frontiers string }
+		if json.Unmarshal([]byte(respString), &respEmpty) == nil && len(respEmpty.Frontiers) == 0 {
+			return map[string]string{}, nil
+		}
 		return nil, err
 	}
 	//fmt.Println(respStruct1)
@@ -124,9 +213,9 @@ func GetFrontiers(accounts []string) (map[string]string, error) {
 }
 
 // GetDifficulty Get current level of difficulty
-func GetDifficulty() (string, error) {
+func (c *Client) GetDifficulty(ctx context.Context) (string, error) {
 	reqJson := `{"action": "active_difficulty"}`
-	respString, err := RpcCall(rpcUrl, reqJson)
+	respString, err := c.rpcCall(ctx, reqJson)
 	//fmt.Println("reqJson %v respString %v \n", reqJson, respString)
 	if err != nil {
 		return "", err
@@ -141,23 +230,26 @@ func GetDifficulty() (string, error) {
 	return respStruct1.NetworkCurrent, nil
 }
 
+// ErrAccountNotFound Returned (wrapped) if the node does not know the account, or the account is invalid
+var ErrAccountNotFound = errors.New("Account not found")
+
 // Get frontier block for an account, using accounts_frontiers
-func GetFrontier(account string) (string, error) {
-	accounts, err := GetFrontiers([]string{account})
+func (c *Client) GetFrontier(ctx context.Context, account string) (string, error) {
+	accounts, err := c.GetFrontiers(ctx, []string{account})
 	if err != nil {
 		return "", err
 	}
 	frontier := accounts[account]
 	if len(frontier) == 0 {
-		return "", errors.New("Could not find account in accounts_frontiers")
+		return "", fmt.Errorf("%w in accounts_frontiers", ErrAccountNotFound)
 	}
 	return frontier, nil
 }
 
 /// Make a generic call to the RPC node
-func MakeGenericCall(reqJSON string) (string, error) {
+func (c *Client) MakeGenericCall(ctx context.Context, reqJSON string) (string, error) {
 	//fmt.Println(reqJson)
-	respString, err := RpcCall(rpcUrl, reqJSON)
+	respString, err := c.rpcCall(ctx, reqJSON)
 	if err != nil {
 		return "", err
 	}
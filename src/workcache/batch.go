@@ -0,0 +1,132 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// BatchItem An item of a batch work request.  Difficulty may be 0, default will be used.
+type BatchItem struct {
+	Hash       string
+	Difficulty uint64
+}
+
+// ErrWorkPending Result of a batch item not finished by the deadline; its computation continues in the background
+var ErrWorkPending = errors.New("Work not ready yet, still being computed")
+
+// batchState Results of a batch, filled by its workers
+type batchState struct {
+	lock     sync.Mutex
+	results  []WorkResponse
+	finished []bool
+	// number of items not finished yet
+	remaining int
+	// closed when all items are finished
+	done chan struct{}
+}
+
+func (b *batchState) set(idx int, resp WorkResponse) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.results[idx] = resp
+	b.finished[idx] = true
+	b.remaining--
+	if b.remaining == 0 {
+		close(b.done)
+	}
+}
+
+// snapshot Copy of the results; unfinished items get ErrWorkPending
+func (b *batchState) snapshot() []WorkResponse {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	results := make([]WorkResponse, len(b.results))
+	for i, resp := range b.results {
+		if !b.finished[i] {
+			resp = WorkResponse{Error: ErrWorkPending}
+		}
+		results[i] = resp
+	}
+	return results
+}
+
+// GenerateBatch Generate work for several hashes at once; results (or errors) are returned per item, in the same order.
+// Items found in the cache are served immediately, the others are computed concurrently, at most MaxOutRequests at a time;
+// they wait for free slots, instead of failing with ErrOverload.
+// Waiting stops when ctx is done.  If partial is set, the results available at that time are returned, the others
+// get ErrWorkPending, and their computation continues in the background (the results go to the cache).
+// Otherwise the unfinished computations are abandoned, and the error of ctx is returned.
+func (s *Service) GenerateBatch(ctx context.Context, items []BatchItem, partial bool) ([]WorkResponse, error) {
+	batch := &batchState{
+		results:  make([]WorkResponse, len(items)),
+		finished: make([]bool, len(items)),
+		done:     make(chan struct{}),
+	}
+	var defaultDiff uint64 = 0
+	diffs := make([]uint64, len(items))
+	var toCompute []int
+	for i, item := range items {
+		diff := item.Difficulty
+		if diff == 0 {
+			if defaultDiff == 0 {
+				defaultDiff = s.client.GetDifficultyCached(ctx)
+			}
+			diff = defaultDiff
+		}
+		found, _, resp := s.getWorkFromCache(WorkRequest{WorkInputHash, item.Hash, diff, ""})
+		if found {
+			// counted and marked as in generate
+			s.metrics.workInReq.Inc()
+			s.metrics.workInReqFromCache.Inc()
+			s.cache.markServed(item.Hash)
+			batch.results[i] = resp
+			batch.finished[i] = true
+			continue
+		}
+		diffs[i] = diff
+		toCompute = append(toCompute, i)
+	}
+	batch.remaining = len(toCompute)
+	if batch.remaining == 0 {
+		return batch.results, nil
+	}
+
+	// computations outlive the request only if partial results are asked for
+	workCtx := ctx
+	if partial {
+		workCtx = s.ctx
+	}
+	workerCount := len(toCompute)
+	if max := s.workOutLimiter.Max(); max > 0 && max < workerCount {
+		workerCount = max
+	}
+	indices := make(chan int, len(toCompute))
+	for _, i := range toCompute {
+		indices <- i
+	}
+	close(indices)
+	for w := 0; w < workerCount; w++ {
+		go func() {
+			for i := range indices {
+				// waits for a free slot, other requests may use the limit too
+				resp, _ := s.generate(workCtx, WorkRequest{WorkInputHash, items[i].Hash, diffs[i], ""}, true)
+				batch.set(i, resp)
+			}
+		}()
+	}
+
+	select {
+	case <-batch.done:
+		return batch.snapshot(), nil
+	case <-ctx.Done():
+		if partial {
+			return batch.snapshot(), nil
+		}
+		// workers finish promptly, as their context is done
+		<-batch.done
+		return batch.snapshot(), ctx.Err()
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+// newTestService Create a service computing work on the CPU; the node is not used (difficulties are given).
+// It is not started, the computations do not need it.
+func newTestService(t *testing.T, maxOutRequests int) *Service {
+	s, err := NewService(Options{
+		Client:         rpcclient.NewClient("http://127.0.0.1:1", "http://127.0.0.1:1"),
+		WorkSources:    []WorkSourceConfig{{Type: WorkSourceTypeCpu, Threads: 1, TimeoutSec: 10}},
+		MaxOutRequests: maxOutRequests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestGenerateBatchWaitsForSlot(t *testing.T) {
+	s := newTestService(t, 1)
+	defer s.Stop()
+	// the only slot is used by another request meanwhile
+	if !s.workOutLimiter.TryAcquire() {
+		t.Fatal("acquire failed")
+	}
+	items := []BatchItem{{testEntry(1).hash, 1}, {testEntry(2).hash, 1}, {testEntry(3).hash, 1}}
+	type batchResult struct {
+		results []WorkResponse
+		err     error
+	}
+	done := make(chan batchResult, 1)
+	go func() {
+		results, err := s.GenerateBatch(context.Background(), items, false)
+		done <- batchResult{results, err}
+	}()
+	select {
+	case r := <-done:
+		t.Fatalf("batch finished while no slot is free, results %v err %v", r.results, r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.workOutLimiter.Release()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		for i, resp := range r.results {
+			if resp.Error != nil {
+				t.Errorf("item %v error %v", i, resp.Error)
+				continue
+			}
+			if _, err := ValidateWork(items[i].Hash, resp.Work, 1); err != nil {
+				t.Errorf("item %v invalid work %v", i, err)
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("batch not finished after the slot is freed")
+	}
+	if s.workOutLimiter.Active() != 0 {
+		t.Errorf("active %v after the batch", s.workOutLimiter.Active())
+	}
+}
+
+func TestGenerateBatchCancelledWhileWaiting(t *testing.T) {
+	s := newTestService(t, 1)
+	defer s.Stop()
+	s.workOutLimiter.TryAcquire()
+	defer s.workOutLimiter.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := s.GenerateBatch(ctx, []BatchItem{{testEntry(1).hash, 1}, {testEntry(2).hash, 1}}, false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("err %v, expected deadline exceeded", err)
+	}
+}
+
+func TestGenerateBatchFromCache(t *testing.T) {
+	s := newTestService(t, 1)
+	defer s.Stop()
+	cached := testEntry(1)
+	s.cache.add(cached)
+	results, err := s.GenerateBatch(context.Background(), []BatchItem{{cached.hash, 1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil || results[0].Work != cached.work {
+		t.Errorf("result %v, expected the cached work %v", results[0], cached.work)
+	}
+	if s.metrics.workInReq.Value() != 1 || s.metrics.workInReqFromCache.Value() != 1 {
+		t.Errorf("requests %v from cache %v, expected 1 and 1", s.metrics.workInReq.Value(), s.metrics.workInReqFromCache.Value())
+	}
+	shard := s.cache.shardFor(cached.hash)
+	if !shard.lruItems[cached.hash].Value.(*lruItem).served {
+		t.Error("cached entry not marked as served")
+	}
+}
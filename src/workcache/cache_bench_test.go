@@ -0,0 +1,73 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// Benchmarks of the cache under parallel load, for different numbers of shards (1 shard is a single global lock):
+//
+//	go test ./workcache -run none -bench Cache -cpu 1,4,16
+
+var benchShardCounts = []int{1, 8, 32}
+
+const benchPrefill = 20000
+
+// newBenchCache Create a cache with the given number of shards, filled with benchPrefill entries; returns their hashes
+func newBenchCache(shards int, maxEntries int) (*workCache, []string) {
+	c := newWorkCache(shards, maxEntries, 0)
+	hashes := make([]string, benchPrefill)
+	for i := range hashes {
+		e := testEntry(i)
+		c.add(e)
+		hashes[i] = e.hash
+	}
+	return c, hashes
+}
+
+// BenchmarkCacheGet Lookups of existing entries
+func BenchmarkCacheGet(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			c, hashes := newBenchCache(shards, 0)
+			var seed int64 = 0
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					if _, ok := c.get(hashes[rnd.Intn(len(hashes))]); !ok {
+						b.Error("entry not found")
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCacheAddGet Lookups, with additions of new entries (1 in 10) mixed in; the size limit makes the additions evict
+func BenchmarkCacheAddGet(b *testing.B) {
+	for _, shards := range benchShardCounts {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			c, hashes := newBenchCache(shards, benchPrefill)
+			var seed int64 = 0
+			var next int64 = benchPrefill
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					if rnd.Intn(10) == 0 {
+						e := testEntry(int(atomic.AddInt64(&next, 1)))
+						e.account = fmt.Sprintf("nano_%d", rnd.Intn(1000))
+						c.add(e)
+						continue
+					}
+					c.get(hashes[rnd.Intn(len(hashes))])
+				}
+			})
+		})
+	}
+}
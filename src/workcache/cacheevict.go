@@ -0,0 +1,144 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+// Estimated memory overhead of a cache entry, beyond its strings: the struct, map and LRU list bookkeeping
+const cacheEntryOverheadBytes = 200
+
+// CacheEvictionStats Number of entries evicted from the cache due to its size limits, by reason
+type CacheEvictionStats struct {
+	// Entries whose work has already been returned to a client
+	Served int64
+	// Entries of an account for which a newer entry exists
+	StaleFrontier int64
+	// Other entries, least recently used
+	LRU int64
+}
+
+// lruItem Eviction bookkeeping of a valid cache entry
+type lruItem struct {
+	hash   string
+	size   int64
+	served bool
+	// set if in the evict-first list: served, or of a stale frontier
+	evictFirst bool
+}
+
+// entrySizeBytes Estimate the memory used by an entry
+func entrySizeBytes(e CacheEntry) int64 {
+	return int64(len(e.hash)+len(e.work)+len(e.account)+len(e.status)) + cacheEntryOverheadBytes
+}
+
+// track Update the bookkeeping for an added entry, as most recently used.  Only valid entries are tracked.
+// Should be called under lock.
+func (s *cacheShard) track(e CacheEntry) {
+	s.untrack(e.hash)
+	if !cacheIsValid(e) {
+		return
+	}
+	item := &lruItem{hash: e.hash, size: entrySizeBytes(e)}
+	s.lruItems[e.hash] = s.lruNormal.PushBack(item)
+	s.bytes += item.size
+}
+
+// untrack Remove an entry from the bookkeeping, if present.  Should be called under lock.
+func (s *cacheShard) untrack(hash string) {
+	elem, ok := s.lruItems[hash]
+	if !ok {
+		return
+	}
+	item := elem.Value.(*lruItem)
+	if item.evictFirst {
+		s.lruEvictFirst.Remove(elem)
+	} else {
+		s.lruNormal.Remove(elem)
+	}
+	delete(s.lruItems, hash)
+	s.bytes -= item.size
+}
+
+// touch Mark an entry as recently used.  Should be called under lock.
+func (s *cacheShard) touch(hash string) {
+	elem, ok := s.lruItems[hash]
+	if !ok {
+		return
+	}
+	if elem.Value.(*lruItem).evictFirst {
+		s.lruEvictFirst.MoveToBack(elem)
+	} else {
+		s.lruNormal.MoveToBack(elem)
+	}
+}
+
+// markEvictFirst Move an entry to the evict-first list, as it is a stale frontier
+func (s *cacheShard) markEvictFirst(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.setEvictFirst(hash)
+}
+
+// setEvictFirst Move an entry to the evict-first list.  Should be called under lock.
+func (s *cacheShard) setEvictFirst(hash string) {
+	elem, ok := s.lruItems[hash]
+	if !ok {
+		return
+	}
+	item := elem.Value.(*lruItem)
+	if item.evictFirst {
+		return
+	}
+	s.lruNormal.Remove(elem)
+	item.evictFirst = true
+	s.lruItems[hash] = s.lruEvictFirst.PushBack(item)
+}
+
+// markServed Record that the work of an entry has been returned to a client; it is likely not needed any more
+func (s *cacheShard) markServed(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elem, ok := s.lruItems[hash]
+	if !ok {
+		return
+	}
+	elem.Value.(*lruItem).served = true
+	s.setEvictFirst(hash)
+}
+
+func (s *cacheShard) overLimit() bool {
+	return (s.maxEntries > 0 && len(s.lruItems) > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// evict Remove entries while the cache is over its limits: first the served ones and stale frontiers,
+// then the least recently used ones.  Returns the entries removed.  Should be called under lock.
+func (s *cacheShard) evict() []CacheEntry {
+	var evicted []CacheEntry
+	for s.overLimit() {
+		elem := s.lruEvictFirst.Front()
+		if elem == nil {
+			elem = s.lruNormal.Front()
+		}
+		if elem == nil {
+			break
+		}
+		item := elem.Value.(*lruItem)
+		switch {
+		case item.served:
+			s.evictions.Served++
+		case item.evictFirst:
+			s.evictions.StaleFrontier++
+		default:
+			s.evictions.LRU++
+		}
+		evicted = append(evicted, s.entries[item.hash])
+		s.untrack(item.hash)
+		delete(s.entries, item.hash)
+	}
+	return evicted
+}
+
+// evictionStats Return the eviction counters, and the estimated memory size of the entries
+func (s *cacheShard) evictionStats() (CacheEvictionStats, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.evictions, s.bytes
+}
@@ -0,0 +1,359 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Version of the cache file format, in the header:
+// 0: no header, entries in the legacy positional format (see entryToString);
+// 1: header, entries in the legacy positional format;
+// 2: header, entries in JSON, one per line (see encodeEntry)
+const cacheFileVersion = 2
+
+const cacheFileHeaderPrefix = "# nano-work-cache"
+
+// cacheFileHeader The first line of the cache file.  Fixed width, so it can be filled in after the entries are written.
+func cacheFileHeader(version int, count int, checksum uint32) string {
+	return fmt.Sprintf("%v version %d entries %010d crc32 %08x\n", cacheFileHeaderPrefix, version, count, checksum)
+}
+
+// parseCacheFileHeader Parse the header line; returns false if it is not a header
+func parseCacheFileHeader(line string) (int, int, uint32, bool) {
+	var version, count int
+	var checksum uint32
+	if !strings.HasPrefix(line, cacheFileHeaderPrefix+" ") {
+		return 0, 0, 0, false
+	}
+	_, err := fmt.Sscanf(line[len(cacheFileHeaderPrefix)+1:], "version %d entries %d crc32 %x", &version, &count, &checksum)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return version, count, checksum, true
+}
+
+// writeFileAtomic Write a file through a temporary file, which is synced to disk, then renamed to the final name.
+// A crash never leaves a partially written file under the final name, nor a missing file.
+// If keepBackup is set, the previous file is kept under the backup name too.
+func writeFileAtomic(filename string, keepBackup bool, write func(file *os.File) error) error {
+	tmpName := filename + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open file; %v", err)
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	errClose := file.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if keepBackup {
+		// the previous file stays in place until replaced by the rename
+		err = backupFile(filename)
+		if err != nil {
+			_ = os.Remove(tmpName)
+			return fmt.Errorf("could not create backup file; %v", err)
+		}
+	}
+	err = os.Rename(tmpName, filename)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
+
+// backupFile Put a copy of the file under the backup name (a hard link, or a real copy where links are not possible);
+// the file itself is not changed.  No error if the file does not exist.
+func backupFile(filename string) error {
+	backupName := backupFileName(filename)
+	tmpName := backupName + ".tmp"
+	_ = os.Remove(tmpName)
+	err := os.Link(filename, tmpName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		err = copyFile(filename, tmpName)
+		if err != nil {
+			_ = os.Remove(tmpName)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	return os.Rename(tmpName, backupName)
+}
+
+// copyFile Copy the content of a file to a new file, synced to disk
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	errClose := out.Close()
+	if err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// syncDir Sync a directory, so that renames in it are durable.  Errors are ignored, not supported on all platforms.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+const (
+	// CompressionNone Cache file is plain text
+	CompressionNone = "none"
+	// CompressionGzip Cache file is compressed with gzip
+	CompressionGzip = "gzip"
+	// CompressionZstd Cache file is compressed with zstd
+	CompressionZstd = "zstd"
+)
+
+// Magic bytes at the start of compressed files
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// cacheFileInfo Properties of a cache file, from its header
+type cacheFileInfo struct {
+	version     int
+	compression string
+}
+
+// saveToFile Save cache entries to the given file, atomically, optionally compressed.
+// If backup is set, the previous file is kept as backup (replacing the previous backup).
+func saveToFile(entries []CacheEntry, filename string, compression string, backup bool) error {
+	// header comes first, so count and checksum are computed in a first pass
+	checksum := crc32.NewIEEE()
+	var cnt int = 0
+	for _, entry := range entries {
+		line := encodeEntry(entry)
+		if len(line) > 0 {
+			fmt.Fprintln(checksum, line)
+			cnt++
+		}
+	}
+	return writeFileAtomic(filename, backup, func(file *os.File) error {
+		var out io.Writer = file
+		// closes the compressor, flushing its output
+		var closeOut func() error = nil
+		switch compression {
+		case CompressionGzip:
+			gz := gzip.NewWriter(file)
+			out, closeOut = gz, gz.Close
+		case CompressionZstd:
+			zw, err := zstd.NewWriter(file)
+			if err != nil {
+				return err
+			}
+			out, closeOut = zw, zw.Close
+		}
+		writer := bufio.NewWriter(out)
+		writer.WriteString(cacheFileHeader(cacheFileVersion, cnt, checksum.Sum32()))
+		for _, entry := range entries {
+			line := encodeEntry(entry)
+			if len(line) > 0 {
+				fmt.Fprintln(writer, line)
+			}
+		}
+		err := writer.Flush()
+		if err != nil {
+			return err
+		}
+		if closeOut != nil {
+			return closeOut()
+		}
+		return nil
+	})
+}
+
+// openCacheFile Open a cache file for reading; compression is detected from the first bytes
+func openCacheFile(filename string) (io.Reader, string, func(), error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, "", nil, err
+		}
+		return gz, CompressionGzip, func() { gz.Close(); file.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, "", nil, err
+		}
+		return zr, CompressionZstd, func() { zr.Close(); file.Close() }, nil
+	default:
+		return reader, CompressionNone, func() { file.Close() }, nil
+	}
+}
+
+// verifyCacheFile Check the integrity of a cache file: entry count and checksum in the header.
+// Files without header (older format) cannot be verified by checksum; they are accepted if all their lines are
+// complete entries, or, if not strict (no other file to fall back to), accepted anyway.
+// Returns the format version and compression.
+func verifyCacheFile(filename string, strict bool) (cacheFileInfo, error) {
+	input, compression, closeFile, err := openCacheFile(filename)
+	if err != nil {
+		return cacheFileInfo{}, err
+	}
+	defer closeFile()
+	info := cacheFileInfo{0, compression}
+
+	reader := bufio.NewReader(input)
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return info, err
+	}
+	version, count, checksum, ok := parseCacheFileHeader(header)
+	if !ok {
+		err = verifyHeaderlessLines(header, reader)
+		if err != nil {
+			if strict {
+				return info, fmt.Errorf("cache file without header, %v, %v", err.Error(), filename)
+			}
+			log.Println("WARNING", "Cache file has no header, and it is damaged, loading what is readable;", err.Error(), filename)
+			return info, nil
+		}
+		log.Println("Cache file has no header, older format, all lines readable;", filename)
+		return info, nil
+	}
+	info.version = version
+	if version > cacheFileVersion {
+		return info, fmt.Errorf("unsupported cache file version %v, %v", version, filename)
+	}
+	actualChecksum := crc32.NewIEEE()
+	var actualCount int = 0
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if !strings.HasSuffix(line, "\n") {
+				return info, fmt.Errorf("cache file is truncated, %v", filename)
+			}
+			actualChecksum.Write([]byte(line))
+			actualCount++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, err
+		}
+	}
+	if actualCount != count || actualChecksum.Sum32() != checksum {
+		return info, fmt.Errorf("cache file is corrupt, entries %v (expected %v), checksum %08x (expected %08x), %v",
+			actualCount, count, actualChecksum.Sum32(), checksum, filename)
+	}
+	return info, nil
+}
+
+// verifyHeaderlessLines Check that all lines of a file without header (older format) are complete entries;
+// firstLine is the already read first line.  An empty file is not accepted.
+func verifyHeaderlessLines(firstLine string, reader *bufio.Reader) error {
+	line := firstLine
+	var cnt int = 0
+	for {
+		if len(line) > 0 {
+			if !strings.HasSuffix(line, "\n") {
+				return errors.New("file is truncated")
+			}
+			trimmed := strings.TrimSpace(line)
+			var entry CacheEntry
+			if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "#") && !decodeEntry(trimmed, &entry) {
+				return fmt.Errorf("unreadable line %v", cnt+1)
+			}
+			cnt++
+		}
+		var err error
+		line, err = reader.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if cnt == 0 {
+		return errors.New("file is empty")
+	}
+	return nil
+}
+
+// loadFromFile Read cache entries from the given file, fn is called for each.  Unparseable lines are skipped.
+// Both the current and the legacy entry formats are accepted, compressed or not.
+func loadFromFile(filename string, fn func(entry CacheEntry)) error {
+	input, _, closeFile, err := openCacheFile(filename)
+	if err != nil {
+		log.Println("Error loading cache from file, could not open file;", err.Error())
+		return err
+	}
+	defer closeFile()
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		// one entry is one line
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			// header
+			continue
+		}
+		var entry CacheEntry
+		lineParsed := decodeEntry(line, &entry)
+		if !lineParsed {
+			continue
+		}
+		fn(entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Println("Error reading cache file", filename, ";", err.Error())
+		return err
+	}
+	log.Printf("Cache file read, %v\n", filename)
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "workcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// headerlessContent File content in the older format, without header
+func headerlessContent(entries []CacheEntry) string {
+	var buf strings.Builder
+	for _, e := range entries {
+		buf.WriteString(encodeEntry(e) + "\n")
+	}
+	return buf.String()
+}
+
+func TestSaveToFileKeepsBackup(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.dat")
+
+	if err := saveToFile(testEntries(0, 10), filename, CompressionNone, true); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ioutil.ReadFile(filename)
+	if err := saveToFile(testEntries(0, 20), filename, CompressionNone, true); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ioutil.ReadFile(filename)
+	backup, err := ioutil.ReadFile(backupFileName(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != string(first) {
+		t.Error("backup is not the previous file")
+	}
+	if string(second) == string(first) {
+		t.Error("file has not been replaced")
+	}
+	// backup is replaced by the next save, without changing the file
+	if err := saveToFile(testEntries(0, 30), filename, CompressionNone, true); err != nil {
+		t.Fatal(err)
+	}
+	backup, _ = ioutil.ReadFile(backupFileName(filename))
+	if string(backup) != string(second) {
+		t.Error("backup is not the previous file, after second save")
+	}
+	if _, err := os.Stat(backupFileName(filename) + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary backup file left over")
+	}
+}
+
+func TestLoadHeaderlessFile(t *testing.T) {
+	complete := headerlessContent(testEntries(0, 10))
+	tests := []struct {
+		name      string
+		primary   string
+		withBak   bool
+		expectCnt int
+	}{
+		{"complete, with backup", complete, true, 10},
+		{"truncated, with backup", complete[:len(complete)-20], true, 5},
+		{"garbage, with backup", "garbage\n" + complete, true, 5},
+		{"empty, with backup", "", true, 5},
+		{"truncated, no backup", complete[:len(complete)-20], false, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestDir(t)
+			defer os.RemoveAll(dir)
+			filename := filepath.Join(dir, "cache.dat")
+			if tt.withBak {
+				if err := saveToFile(testEntries(0, 5), backupFileName(filename), CompressionNone, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filename, []byte(tt.primary), 0644); err != nil {
+				t.Fatal(err)
+			}
+			b, err := newFileBackend(filename, CompressionNone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.close()
+			entries, err := loadBackend(t, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.expectCnt {
+				t.Errorf("expected %v entries, got %v", tt.expectCnt, len(entries))
+			}
+		})
+	}
+}
+
+func TestCacheFileCompression(t *testing.T) {
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			dir := newTestDir(t)
+			defer os.RemoveAll(dir)
+			filename := filepath.Join(dir, "cache.dat")
+			if err := saveToFile(testEntries(0, 50), filename, compression, true); err != nil {
+				t.Fatal(err)
+			}
+			info, err := verifyCacheFile(filename, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.compression != compression || info.version != cacheFileVersion {
+				t.Errorf("detected compression %v version %v", info.compression, info.version)
+			}
+			var cnt int = 0
+			if err := loadFromFile(filename, func(e CacheEntry) { cnt++ }); err != nil {
+				t.Fatal(err)
+			}
+			if cnt != 50 {
+				t.Errorf("expected 50 entries, got %v", cnt)
+			}
+			// a backend with other compression converts it
+			b, err := newFileBackend(filename, CompressionZstd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.close()
+			if _, err := loadBackend(t, b); err != nil {
+				t.Fatal(err)
+			}
+			if b.migrate != (compression != CompressionZstd) {
+				t.Errorf("migrate %v", b.migrate)
+			}
+		})
+	}
+}
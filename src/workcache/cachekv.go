@@ -0,0 +1,122 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket of the cache entries; key is hash, value is the entry in the same format as a line in the cache file
+var kvBucketEntries = []byte("entries")
+
+// kvBackend The cache in an embedded key-value store file (B+tree, bbolt); each change is written right away
+type kvBackend struct {
+	db *bolt.DB
+}
+
+func openKVBackend(filename string) (*kvBackend, error) {
+	// the file is locked; do not wait forever if another process has it open
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kvBucketEntries)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &kvBackend{db: db}, nil
+}
+
+// load Read all entries; entries in the legacy format are converted to the current one
+func (b *kvBackend) load(add func(entry CacheEntry), remove func(hash string)) error {
+	var legacy []CacheEntry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvBucketEntries).ForEach(func(k, v []byte) error {
+			var entry CacheEntry
+			if decodeEntry(string(v), &entry) {
+				add(entry)
+				if isLegacyEntryLine(string(v)) {
+					legacy = append(legacy, entry)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	log.Printf("Converting %v cache entries from older format\n", len(legacy))
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(kvBucketEntries)
+		for _, entry := range legacy {
+			if err := bucket.Put([]byte(entry.hash), []byte(encodeEntry(entry))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// put Store an entry.  Concurrent puts are coalesced into one transaction.
+func (b *kvBackend) put(entry CacheEntry) error {
+	line := encodeEntry(entry)
+	if len(line) == 0 {
+		return nil
+	}
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvBucketEntries).Put([]byte(entry.hash), []byte(line))
+	})
+}
+
+func (b *kvBackend) remove(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(kvBucketEntries)
+		for _, hash := range hashes {
+			if err := bucket.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replaceAll Replace all stored entries with the given ones, in one transaction
+func (b *kvBackend) replaceAll(entries []CacheEntry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(kvBucketEntries)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		bucket, err := tx.CreateBucket(kvBucketEntries)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			line := encodeEntry(entry)
+			if len(line) == 0 {
+				continue
+			}
+			if err := bucket.Put([]byte(entry.hash), []byte(line)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkpoint Nothing to do, changes are stored right away
+func (b *kvBackend) checkpoint(snapshot func() []CacheEntry, final bool) error { return nil }
+
+func (b *kvBackend) close() error {
+	return b.db.Close()
+}
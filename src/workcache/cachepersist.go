@@ -4,126 +4,381 @@ package workcache
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-func isPersistToFileEnabled() bool {
-	filename := ConfigGetString("Main.CachePeristFileName")
-	if len(filename) == 0 {
+const (
+	// PersistModeFile The cache is saved to a text file, with changes appended to a journal file in between
+	PersistModeFile = "file"
+	// PersistModeKV The cache is kept in an embedded key-value store file, each change is written right away
+	PersistModeKV = "kv"
+)
+
+// cacheBackend Persistent storage of the cache entries.  Changes (put, remove) are stored as they happen.
+type cacheBackend interface {
+	// load Read all stored entries, add is called for each; remove is called for entries removed since (journal)
+	load(add func(entry CacheEntry), remove func(hash string)) error
+	// put Store an entry, overwriting the previous one with the same hash
+	put(entry CacheEntry) error
+	// remove Remove the entries with the given hashes
+	remove(hashes []string) error
+	// checkpoint Called periodically, and at stop (final).  The backend may write a new snapshot of all entries
+	// (obtained from snapshot), and compact its storage.
+	checkpoint(snapshot func() []CacheEntry, final bool) error
+	close() error
+}
+
+// newCacheBackend Create the backend for the persistence mode
+func newCacheBackend(mode string, filename string, compression string) (cacheBackend, error) {
+	switch mode {
+	case PersistModeFile, "":
+		return newFileBackend(filename, compression)
+	case PersistModeKV:
+		return openKVBackend(filename)
+	default:
+		return nil, fmt.Errorf("Unknown cache persist mode %v", mode)
+	}
+}
+
+func (s *Service) isPersistToFileEnabled() bool {
+	if len(s.opts.CachePersistFileName) == 0 {
 		return false
 	}
 	return true
 }
 
-func persistFileName() string {
-	filename := ConfigGetString("Main.CachePeristFileName")
-	return filename
+// openBackend Open the configured persistence backend (if any), and attach it to the cache
+func (s *Service) openBackend() error {
+	if !s.isPersistToFileEnabled() {
+		return nil
+	}
+	backend, err := newCacheBackend(s.opts.CachePersistMode, s.opts.CachePersistFileName, s.opts.CacheCompression)
+	if err != nil {
+		return err
+	}
+	s.backend = backend
+	return nil
 }
 
-// SaveCache Save the cache to file or other persistence configured
-func SaveCache() {
-	if !isPersistToFileEnabled() {
+// closeBackend Detach and close the persistence backend
+func (s *Service) closeBackend() {
+	if s.backend == nil {
 		return
 	}
-	saveToFile(persistFileName())
+	s.cache.setBackend(nil)
+	err := s.backend.close()
+	if err != nil {
+		log.Println("WARNING", "Error closing cache persistence;", err.Error())
+	}
+	s.backend = nil
 }
 
-func backupFileName(filename string) string {
-	return filename + ".bak"
+// SaveCache Save the cache to file or other persistence configured.  Changes are stored as they happen,
+// this writes a fresh snapshot if needed (e.g. compacts the journal).
+func (s *Service) SaveCache() {
+	s.checkpointCache(true)
 }
 
-// LoadCache Load the cache from file or other persistence configured
-func LoadCache() {
-	if !isPersistToFileEnabled() {
+// checkpointCache Let the backend write a snapshot, if needed (always if final, and there are changes)
+func (s *Service) checkpointCache(final bool) {
+	if s.backend == nil {
 		return
 	}
-	filename := persistFileName()
-	err := loadFromFile(filename)
-	if err == nil {
+	err := s.backend.checkpoint(s.cache.snapshot, final)
+	if err != nil {
+		log.Println("Error saving cache;", err.Error())
+	}
+}
+
+// LoadCache Load the cache from file or other persistence configured, and attach the persistence to the cache
+func (s *Service) LoadCache() {
+	if s.backend == nil {
 		return
 	}
-	// try bak file
-	_ = loadFromFile(backupFileName(filename))
+	var cnt int = 0
+	var cntInvalid int = 0
+	// hashes of the stored entries, to remove those not kept (invalid, or evicted due to the limits) from the store too
+	stored := map[string]bool{}
+	err := s.backend.load(func(entry CacheEntry) {
+		cnt++
+		stored[entry.hash] = true
+		if !validateLoadedEntry(&entry) {
+			cntInvalid++
+			return
+		}
+		s.cache.add(entry)
+	}, func(hash string) {
+		delete(stored, hash)
+		s.cache.remove(hash)
+	})
+	if err != nil {
+		log.Println("Error loading cache;", err.Error())
+	}
+	log.Printf("Cache loaded, %v entries read, %v invalid, %v stored\n", cnt, cntInvalid, s.cache.size())
+	var dropped []string
+	for hash := range stored {
+		if _, ok := s.cache.get(hash); !ok {
+			dropped = append(dropped, hash)
+		}
+	}
+	// after a failed load the store is left as it is, for recovery
+	if len(dropped) > 0 && err == nil {
+		if errRemove := s.backend.remove(dropped); errRemove != nil {
+			log.Println("WARNING", "Could not remove dropped cache entries from store;", errRemove.Error())
+		}
+	}
+	// from now on changes are persisted
+	s.cache.setBackend(s.backend)
+	// convert older formats right away
+	s.checkpointCache(false)
 }
 
-// saveToFile save cache to the given file
-func saveToFile(filename string) {
-	startTime := time.Now()
+// validateLoadedEntry Check a loaded entry; omit non-"valid" entries, invalid work values, and those below the base difficulty.
+// Fills actual difficulty.
+func validateLoadedEntry(entry *CacheEntry) bool {
+	if entry.status != "valid" {
+		return false
+	}
+	actualDiff, err := ValidateWork(entry.hash, entry.work, 0)
+	if err != nil {
+		return false
+	}
+	entry.difficulty = actualDiff
+	entry.multiplier = DifficultyMultiplier(actualDiff)
+	return true
+}
+
+// Number of journal records after which the file snapshot is rewritten, and the journal is cleared
+const journalCompactRecords = 10000
+
+// Time after which the file snapshot is rewritten, if there are any journal records
+const journalCompactPeriod = 1 * time.Hour
+
+// fileBackend The whole cache in a text file (snapshot), one entry per line, and an append-only journal of the changes
+// since.  The journal is replayed on load, and is compacted into a new snapshot periodically.
+type fileBackend struct {
+	filename    string
+	compression string
+	// protects the journal, also during compaction
+	lock           sync.Mutex
+	journal        *os.File
+	journalRecords int
+	lastCompaction time.Time
+	// set if the loaded file is in an older format (or other compression), to be rewritten in the current one
+	migrate bool
+	// set if the snapshot could not be loaded; the backup file is then not replaced by new snapshots
+	keepBackupFile bool
+}
 
-	// fast exclusive local copy
-	workCacheLock.Lock()
-	n := len(workCache)
-	workCacheCopy := make(map[string]CacheEntry, n)
-	for key, entry := range workCache {
-		workCacheCopy[key] = entry
-	}
-	workCacheLock.Unlock()
-	elapsed := time.Now().Sub(startTime)
-	log.Printf("Save: local mem copy is made %v %v, dur %v ms", n, len(workCacheCopy), elapsed.Milliseconds())
-
-	// try to rename old file to .bak (ignore error if not possible / not exists)
-	fileNameBak := backupFileName(filename)
-	_ = os.Remove(fileNameBak)
-	_ = os.Rename(filename, fileNameBak)
-	// open new file for writing
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+func newFileBackend(filename string, compression string) (*fileBackend, error) {
+	if len(compression) == 0 {
+		compression = CompressionNone
+	}
+	b := &fileBackend{filename: filename, compression: compression, lastCompaction: time.Now()}
+	journal, err := os.OpenFile(journalFileName(filename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		log.Println("Error saving cache to file, could not open file;", err.Error())
-		return
+		return nil, err
 	}
-	defer file.Close()
+	b.journal = journal
+	return b, nil
+}
 
-	var cnt int = 0
-	for _, entry := range workCacheCopy {
-		line := entryToString(entry)
-		if len(line) > 0 {
-			fmt.Fprintln(file, entryToString(entry))
-			cnt++
+func backupFileName(filename string) string {
+	return filename + ".bak"
+}
+
+func journalFileName(filename string) string {
+	return filename + ".journal"
+}
+
+// Journal record of an added entry
+func journalAddRecord(entry CacheEntry) string {
+	return "+ " + encodeEntry(entry)
+}
+
+// Journal record of a removed entry
+func journalRemoveRecord(hash string) string {
+	return "- " + hash
+}
+
+// appendJournal Write records to the journal, and flush them to disk
+func (b *fileBackend) appendJournal(records []string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.journal == nil {
+		return errors.New("journal is closed")
+	}
+	var buf strings.Builder
+	for _, r := range records {
+		buf.WriteString(r)
+		buf.WriteString("\n")
+	}
+	_, err := b.journal.WriteString(buf.String())
+	if err != nil {
+		return err
+	}
+	b.journalRecords += len(records)
+	return b.journal.Sync()
+}
+
+func (b *fileBackend) put(entry CacheEntry) error {
+	if len(entry.hash) == 0 {
+		return nil
+	}
+	return b.appendJournal([]string{journalAddRecord(entry)})
+}
+
+func (b *fileBackend) remove(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	records := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		records = append(records, journalRemoveRecord(hash))
+	}
+	return b.appendJournal(records)
+}
+
+// checkpoint Compact: write a new snapshot, and clear the journal, if the journal is large or old enough (or at stop).
+// The journal lock is held meanwhile, so no change can fall between the snapshot and the cleared journal.
+func (b *fileBackend) checkpoint(snapshot func() []CacheEntry, final bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.journal == nil || (b.journalRecords == 0 && !b.migrate) {
+		return nil
+	}
+	if !final && !b.migrate && b.journalRecords < journalCompactRecords && time.Now().Sub(b.lastCompaction) < journalCompactPeriod {
+		return nil
+	}
+	startTime := time.Now()
+	entries := snapshot()
+	err := saveToFile(entries, b.filename, b.compression, !b.keepBackupFile)
+	if err != nil {
+		return err
+	}
+	err = b.journal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	log.Printf("Cache saved to file, %v entries, %v journal records compacted, dur %v ms", len(entries), b.journalRecords, time.Now().Sub(startTime).Milliseconds())
+	b.journalRecords = 0
+	b.lastCompaction = time.Now()
+	b.migrate = false
+	return nil
+}
+
+func (b *fileBackend) close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.journal == nil {
+		return nil
+	}
+	err := b.journal.Close()
+	b.journal = nil
+	return err
+}
+
+// load Read the snapshot (or its backup), then replay the journal on top of it.
+// An error of the snapshot is returned even if the journal could be replayed: the journal holds only the changes
+// since the last compaction, the cache is incomplete without the snapshot.
+func (b *fileBackend) load(add func(entry CacheEntry), remove func(hash string)) error {
+	// verify first, the primary file may be incomplete or corrupt; then the backup is used
+	// an unverifiable primary file is accepted only if there is nothing to fall back to
+	filename := b.filename
+	info, err := verifyCacheFile(filename, fileExists(backupFileName(b.filename)) || fileNotEmpty(journalFileName(b.filename)))
+	if err != nil {
+		log.Println("WARNING", "Cache file not usable, trying backup;", err.Error())
+		filename = backupFileName(b.filename)
+		info, err = verifyCacheFile(filename, false)
+		if err != nil {
+			log.Println("WARNING", "Cache backup file not usable;", err.Error())
+		}
+	}
+	if err == nil {
+		err = loadFromFile(filename, add)
+		if err == nil && (info.version < cacheFileVersion || (len(b.compression) > 0 && info.compression != b.compression)) {
+			log.Printf("Cache file is in older format (version %v, compression %v), will be converted to version %v, compression %v\n",
+				info.version, info.compression, cacheFileVersion, b.compression)
+			b.lock.Lock()
+			b.migrate = true
+			b.lock.Unlock()
+		}
+	}
+	if err != nil || filename != b.filename {
+		if !fileExists(b.filename) && !fileExists(backupFileName(b.filename)) {
+			// no snapshot yet
+			err = nil
+		} else {
+			// the backup may be needed for recovery, it must not be replaced by the next snapshot
+			log.Println("WARNING", "Cache file could not be loaded, its backup is kept;", backupFileName(b.filename))
+			b.lock.Lock()
+			b.keepBackupFile = true
+			b.lock.Unlock()
 		}
 	}
-	elapsed2 := time.Now().Sub(startTime)
-	log.Printf("Cache saved to file, %v entries, dur %v ms", cnt, elapsed2.Milliseconds())
+	records, errJournal := replayJournal(journalFileName(b.filename), add, remove)
+	if errJournal != nil {
+		if err != nil {
+			log.Println("WARNING", "Cache snapshot could not be loaded;", err.Error())
+		}
+		return errJournal
+	}
+	b.lock.Lock()
+	b.journalRecords = records
+	b.lock.Unlock()
+	if records > 0 {
+		log.Printf("Cache journal replayed, %v records\n", records)
+	}
+	return err
 }
 
-// loadFromFile Read cache entries from the given file, merge them with current cache
-func loadFromFile(filename string) error {
+// fileNotEmpty Return true if the file exists and is not empty
+func fileNotEmpty(filename string) bool {
+	stat, err := os.Stat(filename)
+	return err == nil && stat.Size() > 0
+}
+
+// fileExists Return true if the file exists (even if not readable)
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil || !os.IsNotExist(err)
+}
+
+// replayJournal Apply the records of the journal file; returns the number of records.  Incomplete records are skipped.
+func replayJournal(filename string, add func(entry CacheEntry), remove func(hash string)) (int, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Println("Error loading cache from file, could not open file;", err.Error())
-		return err
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
 	}
 	defer file.Close()
 
 	var cnt int = 0
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		// one entry is one line
 		line := scanner.Text()
-		var entry CacheEntry
-		lineParsed := entryLoadFromString(line, &entry)
-		if !lineParsed {
-			continue
-		}
-		cnt++
-		// omit non-"valid" entries
-		if entry.status != "valid" {
-			continue
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			var entry CacheEntry
+			if decodeEntry(line[2:], &entry) {
+				add(entry)
+				cnt++
+			}
+		case strings.HasPrefix(line, "- "):
+			hash := line[2:]
+			if len(hash) > 0 {
+				remove(hash)
+				cnt++
+			}
 		}
-		// omit invalid work vaules
-		if !IsWorkValueValid(entry.work) {
-			continue
-		}
-		addToCacheInternal(entry)
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-		return err
 	}
-
-	log.Printf("Cache loaded from file %v, %v entries read, %v stored\n", filename, cnt, StatusCacheSize())
-	return nil
+	return cnt, scanner.Err()
 }
@@ -0,0 +1,161 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+func testEntry(i int) CacheEntry {
+	return CacheEntry{hash: fmt.Sprintf("%064X", i), work: fmt.Sprintf("%016x", i), difficulty: 1, status: "valid", timeComputed: 1600000000, timeAdded: 1600000000}
+}
+
+func testEntries(from int, to int) []CacheEntry {
+	var entries []CacheEntry
+	for i := from; i < to; i++ {
+		entries = append(entries, testEntry(i))
+	}
+	return entries
+}
+
+// validWorks Work values reaching the base difficulty, for the hashes of testEntry(1..6)
+var validWorks = []string{"10242af7f0d567c8", "6df18dab65809d58", "d1d1a1e2b7372e78", "0dba0ad2ac94d6e9", "c63e20fe60471e8e", "23dd3ef6942bac7a"}
+
+// validTestEntry Entry with valid work, 1 <= i <= 6
+func validTestEntry(i int) CacheEntry {
+	e := testEntry(i)
+	e.work = validWorks[i-1]
+	return e
+}
+
+// loadBackend Load a file backend into a map
+func loadBackend(t *testing.T, b *fileBackend) (map[string]CacheEntry, error) {
+	entries := map[string]CacheEntry{}
+	err := b.load(func(e CacheEntry) { entries[e.hash] = e }, func(hash string) { delete(entries, hash) })
+	return entries, err
+}
+
+func TestFileBackendSnapshotFailedWithJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.dat")
+
+	// backup and primary, then both damaged; some changes in the journal
+	if err := saveToFile(testEntries(0, 100), filename, CompressionNone, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveToFile(testEntries(0, 100), filename, CompressionNone, true); err != nil {
+		t.Fatal(err)
+	}
+	// header of 100 entries, but no entries
+	backupContent := []byte(cacheFileHeader(cacheFileVersion, 100, 0))
+	if err := ioutil.WriteFile(backupFileName(filename), backupContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, backupContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newFileBackend(filename, CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	if err := b.put(testEntry(200)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := loadBackend(t, b)
+	if err == nil {
+		t.Error("expected error, snapshot could not be loaded")
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the journal entry, got %v", len(entries))
+	}
+	// a checkpoint must not replace the backup
+	if err := b.checkpoint(func() []CacheEntry { return testEntries(200, 201) }, true); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(backupFileName(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(backupContent) {
+		t.Error("backup file has been replaced")
+	}
+}
+
+func TestFileBackendNoSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := newFileBackend(filepath.Join(dir, "cache.dat"), CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+	if err := b.put(testEntry(1)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := loadBackend(t, b)
+	if err != nil {
+		t.Errorf("unexpected error without snapshot; %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected 1 entry, got %v", len(entries))
+	}
+}
+
+func TestKVLoadRemovesDroppedEntries(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.db")
+	// more valid entries than the limit, and some invalid ones
+	var entries []CacheEntry
+	for i := 1; i <= 6; i++ {
+		entries = append(entries, validTestEntry(i))
+	}
+	entries = append(entries, testEntry(7), testEntry(8))
+	if err := WriteCacheStore(entries, PersistModeKV, filename, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for restart := 0; restart < 2; restart++ {
+		s, err := NewService(Options{
+			Client:               rpcclient.NewClient("http://127.0.0.1:1", "http://127.0.0.1:1"),
+			CachePersistFileName: filename,
+			CachePersistMode:     PersistModeKV,
+			CacheShardCount:      1,
+			MaxCacheEntries:      4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		size := s.cache.size()
+		s.Stop()
+		if size != 4 {
+			t.Errorf("restart %v: cache size %v, expected 4", restart, size)
+		}
+		stored, err := ReadCacheStore(PersistModeKV, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 4 {
+			t.Errorf("restart %v: store size %v, expected 4", restart, len(stored))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheShard A part of the cache entries, with its own lock, limits and eviction bookkeeping
+type cacheShard struct {
+	// The entries, key is hash
+	entries map[string]CacheEntry
+	// Mutex to protect write and enumeration
+	lock sync.Mutex
+
+	// Limits on the number of valid entries, and on their estimated memory size; 0 means no limit
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	// Valid entries in least recently used order (least recent at front).  Entries already served,
+	// or of stale frontiers, are in lruEvictFirst, they are evicted before the others.
+	lruNormal     *list.List
+	lruEvictFirst *list.List
+	lruItems      map[string]*list.Element
+	evictions     CacheEvictionStats
+}
+
+func newCacheShard(maxEntries int, maxBytes int64) *cacheShard {
+	return &cacheShard{
+		entries:       map[string]CacheEntry{},
+		maxEntries:    maxEntries,
+		maxBytes:      maxBytes,
+		lruNormal:     list.New(),
+		lruEvictFirst: list.New(),
+		lruItems:      map[string]*list.Element{},
+	}
+}
+
+// add Add or replace an entry, as most recently used (or as evict-first, if stale); returns the entries evicted due to the limits
+func (s *cacheShard) add(e CacheEntry, stale bool) []CacheEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[e.hash] = e
+	s.track(e)
+	if stale {
+		s.setEvictFirst(e.hash)
+	}
+	return s.evict()
+}
+
+func (s *cacheShard) removeComputing(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[hash]
+	if ok && e.status == "computing" {
+		s.untrack(hash)
+		delete(s.entries, hash)
+	}
+}
+
+func (s *cacheShard) remove(hash string) (CacheEntry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[hash]
+	if ok {
+		s.untrack(hash)
+		delete(s.entries, hash)
+	}
+	return e, ok
+}
+
+func (s *cacheShard) get(hash string) (CacheEntry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[hash]
+	if ok {
+		s.touch(hash)
+	}
+	return e, ok
+}
+
+func (s *cacheShard) size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+// appendEntries Append a copy of all entries to the list
+func (s *cacheShard) appendEntries(entries []CacheEntry) []CacheEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// removeOlderThan Remove the entries computed before the cutoff time; returns the previous size, and the removed entries
+func (s *cacheShard) removeOlderThan(cutoffTime int64) (int, []CacheEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldSize := len(s.entries)
+	var removed []CacheEntry
+	for key, entry := range s.entries {
+		if entry.timeComputed < cutoffTime {
+			s.untrack(key)
+			delete(s.entries, key)
+			removed = append(removed, entry)
+		}
+	}
+	return oldSize, removed
+}
@@ -0,0 +1,124 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Offline access to a persisted cache, for tools.  The service must not be running on the same files meanwhile.
+
+// Hash Return the block hash of the entry
+func (e CacheEntry) Hash() string { return e.hash }
+
+// Work Return the work value of the entry
+func (e CacheEntry) Work() string { return e.work }
+
+// Difficulty Return the difficulty of the work, as stored
+func (e CacheEntry) Difficulty() uint64 { return e.difficulty }
+
+// Multiplier Return the difficulty multiplier of the work, as stored
+func (e CacheEntry) Multiplier() float64 { return e.multiplier }
+
+// Account Return the account of the entry; may be empty
+func (e CacheEntry) Account() string { return e.account }
+
+// Status Return the status of the entry: valid, computing
+func (e CacheEntry) Status() string { return e.status }
+
+// TimeComputed Return the time the work was computed, unix time
+func (e CacheEntry) TimeComputed() int64 { return e.timeComputed }
+
+// TimeAdded Return the time the entry was added to the cache, unix time
+func (e CacheEntry) TimeAdded() int64 { return e.timeAdded }
+
+// EncodeCacheEntry Convert an entry to its single-line serialized form, as in the cache file (JSON)
+func EncodeCacheEntry(entry CacheEntry) string {
+	return encodeEntry(entry)
+}
+
+// DecodeCacheEntry Parse an entry from its single-line serialized form; the legacy format is also accepted
+func DecodeCacheEntry(line string) (CacheEntry, bool) {
+	var entry CacheEntry
+	ok := decodeEntry(line, &entry)
+	return entry, ok
+}
+
+// ValidateCacheEntry Check the work of an entry against its hash.  Returns the entry with the actual difficulty
+// and multiplier filled, or an error if the work is not valid (or below the base difficulty).
+func ValidateCacheEntry(entry CacheEntry) (CacheEntry, error) {
+	actualDiff, err := ValidateWork(entry.hash, entry.work, 0)
+	if err != nil {
+		return entry, err
+	}
+	entry.difficulty = actualDiff
+	entry.multiplier = DifficultyMultiplier(actualDiff)
+	return entry, nil
+}
+
+// ReadCacheStore Read all entries of a persisted cache: the cache file with its journal (PersistModeFile),
+// or the key-value store file (PersistModeKV).  Entries are returned ordered by hash.
+func ReadCacheStore(mode string, filename string) ([]CacheEntry, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	var backend cacheBackend
+	switch mode {
+	case PersistModeFile, "":
+		// the journal is only read, no need to open it for writing; any compression is fine
+		backend = &fileBackend{filename: filename}
+	case PersistModeKV:
+		kv, err := openKVBackend(filename)
+		if err != nil {
+			return nil, err
+		}
+		backend = kv
+	default:
+		return nil, fmt.Errorf("Unknown cache persist mode %v", mode)
+	}
+	defer backend.close()
+	entries := map[string]CacheEntry{}
+	err := backend.load(
+		func(entry CacheEntry) { entries[entry.hash] = entry },
+		func(hash string) { delete(entries, hash) })
+	if err != nil {
+		return nil, err
+	}
+	list := make([]CacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].hash < list[j].hash })
+	return list, nil
+}
+
+// WriteCacheStore Replace the content of a persisted cache with the given entries, creating it if needed.
+// In PersistModeFile the file is written atomically (the previous one is kept as backup), and the journal is cleared.
+func WriteCacheStore(entries []CacheEntry, mode string, filename string, compression string) error {
+	switch mode {
+	case PersistModeFile, "":
+		if len(compression) == 0 {
+			compression = CompressionNone
+		}
+		err := saveToFile(entries, filename, compression, true)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(journalFileName(filename))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case PersistModeKV:
+		kv, err := openKVBackend(filename)
+		if err != nil {
+			return err
+		}
+		defer kv.close()
+		return kv.replaceAll(entries)
+	default:
+		return fmt.Errorf("Unknown cache persist mode %v", mode)
+	}
+}
@@ -4,12 +4,11 @@ package workcache
 
 import (
 	//"fmt"
-	"errors"
+	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
-
-	"github.com/catenocrypt/nano-work-cache/rpcclient"
 )
 
 const (
@@ -34,103 +33,132 @@ type WorkResponse struct {
 	Error  error
 }
 
-var maxOutRequests int = 0
-var maxCacheAgeDays int = 0
-var statusWorkOutReqCount int = 0
-var statusWorkOutRespCount int = 0
-var statusWorkOutDurationTotal int64 = 0
-var statusWorkInReqCount int = 0
-var statusWorkInReqFromCache int = 0
-var statusWorkInReqError int = 0
-
-// Start Invoked at the beginning, can perform initializations, read the cache, etc.
-func Start() {
-	backgroundWorkerCount := ConfigBackgroundWorkerCount()
-	maxOutRequests = ConfigMaxOutRequests()
-	maxCacheAgeDays = ConfigMaxCacheAgeDays()
-	InitQueue()
-	LoadCache()
-	RemoveOldEntries(float64(maxCacheAgeDays))
-	startWorkers(backgroundWorkerCount)
-	go housekeepingCycle()
-}
-
 // Generate Generate work or take from cache. Generation done in foreground.
 // Account is optional, may by empty.
-// Difficulty may be 0, default will be used
-func Generate(hash string, difficulty uint64, account string) (WorkResponse, error) {
-	req := WorkRequest{WorkInputHash, hash, difficulty, account}
-	resp, fromcache := getCachedWork(req)
-	statusWorkInReqCount++
+// Difficulty may be 0, default will be used.
+// Waiting for an in-progress computation stops when ctx is done.
+func (s *Service) Generate(ctx context.Context, hash string, difficulty uint64, account string) (WorkResponse, error) {
+	return s.generate(ctx, WorkRequest{WorkInputHash, hash, difficulty, account}, false)
+}
+
+// generate Generate work or take from cache, see Generate.  If waitForSlot is set, a new computation waits for
+// a free slot within the limit of outgoing work requests, instead of failing with ErrOverload.
+func (s *Service) generate(ctx context.Context, req WorkRequest, waitForSlot bool) (WorkResponse, error) {
+	resp, fromcache := s.getCachedWork(ctx, req, waitForSlot)
+	s.metrics.workInReq.Inc()
 	if fromcache {
-		statusWorkInReqFromCache++
+		s.metrics.workInReqFromCache.Inc()
 	}
 	if resp.Error != nil || !IsWorkValueValid(resp.Work) {
-		statusWorkInReqError++
+		s.metrics.workInReqError.Inc()
+		return resp, resp.Error
 	}
+	// the work is likely used now, the entry is evicted first if the cache is full
+	s.cache.markServed(req.Hash)
 	return resp, resp.Error
 }
 
+// WaitForWork Wait until valid work for the hash is in the cache, without starting a computation.
+// It is notified by the work results, as the waiters of in-flight computations.  Difficulty may be 0, default will be used.
+// Waiting stops when ctx is done, or after timeout with ErrWaitTimeout; 0 means the WorkWaitTimeout option.
+// If a computation for the hash fails meanwhile, its error is returned; computations not started due to overload,
+// or abandoned by their requester, do not end the wait.
+func (s *Service) WaitForWork(ctx context.Context, hash string, difficulty uint64, timeout time.Duration) (WorkResponse, error) {
+	if difficulty == 0 {
+		difficulty = s.client.GetDifficultyCached(ctx)
+	}
+	req := WorkRequest{WorkInputHash, hash, difficulty, ""}
+	events := make(chan WorkEvent, 1)
+	removeListener := s.AddWorkListener(func(event WorkEvent) {
+		if event.Hash != hash {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+			// an event is pending already, the cache is checked anyway
+		}
+	})
+	defer removeListener()
+
+	// listening already, so a result cannot be missed between the check and the wait
+	if timeout <= 0 {
+		timeout = s.opts.WorkWaitTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		found, _, resp := s.getWorkFromCache(req)
+		if found {
+			s.cache.markServed(hash)
+			return resp, nil
+		}
+		select {
+		case event := <-events:
+			if event.Error != nil && !IsWaitableError(event.Error) {
+				return WorkResponse{Error: event.Error}, event.Error
+			}
+			// check in cache again; it may be for a lower difficulty
+		case <-timer.C:
+			return WorkResponse{Error: ErrWaitTimeout}, ErrWaitTimeout
+		case <-ctx.Done():
+			return WorkResponse{Error: ctx.Err()}, ctx.Err()
+		case <-s.ctx.Done():
+			return WorkResponse{Error: ErrServiceStopped}, ErrServiceStopped
+		}
+	}
+}
+
 // PregenerateByHash Enqueue a pregeneration request, by hash
 // Account is optional, may by empty.
 // Default difficulty will be used
-func PregenerateByHash(hash string, account string) {
+func (s *Service) PregenerateByHash(hash string, account string) {
 	req := WorkRequest{WorkInputHash, hash, 0, account}
 	// check in cache
-	found, _, _ := getWorkFromCache(req)
-	if found {
-		// found in cache, no need to compute
+	found, _, _ := s.getWorkFromCache(req)
+	if found || s.isInflight(hash) {
+		// found in cache or being computed, no need to compute
 		return
 	}
-	addPregenerateRequest(req)
+	s.addPregenerateRequest(req)
 }
 
 // PregenerateByAccount Enqueue a pregeneration request, by account
 // Default difficulty will be used
-func PregenerateByAccount(account string) {
+func (s *Service) PregenerateByAccount(ctx context.Context, account string) {
 	req := WorkRequest{WorkInputAccount, "", 0, account}
 	// check if frontier hash has work in cache
 	// get frontier of account
-	hash, err := GetFrontierHash(account)
+	hash, err := s.GetFrontierHash(ctx, account)
 	if err != nil {
 		// could not get frontier, add it as fallback
-		addPregenerateRequest(req)
+		s.addPregenerateRequest(req)
 		return
 	}
 	// check in cache
-	found, _, _ := getWorkFromCache(WorkRequest{WorkInputHash, hash, 0, account})
+	found, _, _ := s.getWorkFromCache(WorkRequest{WorkInputHash, hash, 0, account})
 	if found {
 		// found in cache, no need to compute
 		return
 	}
 	// not found, add pregenerate request, but by account
-	addPregenerateRequest(req)
+	s.addPregenerateRequest(req)
 }
 
-func waitForCacheResult(req WorkRequest) (WorkResponse, error) {
-	// TODO do with events, timeout
-	for i := 0; i < 100-1; i++ {
-		found, _, resp := getWorkFromCache(req)
-		if found {
-			return resp, resp.Error
-		}
-		// not found, wait
-		time.Sleep(250 * time.Millisecond)
-	}
-	// not found
-	return WorkResponse{}, errors.New("Timeout in work generation")
-}
-
-// Check is a work value string looks valid: not empty, hex string
+// IsWorkValueValid Check if a work value string looks valid: 16 hex digits.  See also ValidateWork.
 func IsWorkValueValid(work string) bool {
-	return len(work) > 9
+	if len(work) != 16 {
+		return false
+	}
+	_, err := strconv.ParseUint(work, 16, 64)
+	return err == nil
 }
 
 // getWorkFromCache Try to get work from cache, nil is returned if not found in cache, or not valid
 // Returns if valid work found in cache
 // Returns if computation is in progress
-func getWorkFromCache(req WorkRequest) (bool, bool, WorkResponse) {
-	cachedEntry, ok := getFromCache(req.Hash)
+func (s *Service) getWorkFromCache(req WorkRequest) (bool, bool, WorkResponse) {
+	cachedEntry, ok := s.cache.get(req.Hash)
 	if !ok {
 		return false, false, WorkResponse{}
 	}
@@ -139,139 +167,189 @@ func getWorkFromCache(req WorkRequest) (bool, bool, WorkResponse) {
 		// found in cache, but not (yet) valid
 		return false, true, WorkResponse{}
 	}
-	if !IsWorkValueValid(cachedEntry.work) {
-		log.Println("WARNING", "Invalid work value found in cache", cachedEntry.work, cachedEntry.hash)
-		return false, false, WorkResponse{}
-	}
-	if !cacheDiffIsOK(cachedEntry, req.Diff) {
+	actualDiff, err := ValidateWork(cachedEntry.hash, cachedEntry.work, req.Diff)
+	if err != nil {
+		if actualDiff == 0 {
+			log.Println("WARNING", "Invalid work value found in cache", cachedEntry.work, cachedEntry.hash, err.Error())
+			return false, false, WorkResponse{}
+		}
 		// found but diff is smaller, must recompute
-		log.Println("WARNING", "Found in cache, buf diff is smaller, hash", req.Hash, "cdiff", cachedEntry.difficulty, "diff", req.Diff)
+		log.Println("WARNING", "Found in cache, buf diff is smaller, hash", req.Hash, "cdiff", actualDiff, "diff", req.Diff)
 		return false, false, WorkResponse{}
 	}
 	// found in cache, use it
 	return true, false, WorkResponse{
 		cachedEntry.hash,
 		cachedEntry.work,
-		cachedEntry.difficulty,
-		cachedEntry.multiplier,
+		actualDiff,
+		DifficultyMultiplier(actualDiff),
 		"cache",
 		nil,
 	}
 }
 
+// Max number of in-flight computations joined by a request; if each of them yields work for a lower difficulty,
+// the work is computed directly
+const maxInflightJoins = 3
+
 // getCachedWork Retrieve work for a given hash; either from cache (if exists), or computed afresh from node.
-// Account is optional (may be empty).
+// If computation is already in progress for the hash, its result is waited for.
+// Account is optional (may be empty).  For waitForSlot see generate.
 // Return response and true if it is taken from cache
-func getCachedWork(req WorkRequest) (WorkResponse, bool) {
+func (s *Service) getCachedWork(ctx context.Context, req WorkRequest, waitForSlot bool) (WorkResponse, bool) {
 	// Fill difficuly if missing
 	if req.Diff == 0 {
-		req.Diff = rpcclient.GetDifficultyCached()
-	}
-	// get from cache
-	found, inprogress, respFromCache := getWorkFromCache(req)
-	if found {
-		// found in cache, use it
-		return respFromCache, true
+		req.Diff = s.client.GetDifficultyCached(ctx)
 	}
-	if inprogress {
-		// computation is in progress, wait
-		log.Println("WARNING", "Work in progress but requested again, waiting; hash", req.Hash)
-		// wait for result
-		resp, err := waitForCacheResult(req)
-		if err != nil {
-			// non-success (timeout), do not count as cache success
-			return WorkResponse{Error: err}, false
+	for joins := 0; joins < maxInflightJoins; joins++ {
+		// get from cache
+		found, _, respFromCache := s.getWorkFromCache(req)
+		if found {
+			// found in cache, use it
+			return respFromCache, true
+		}
+		call, started := s.joinInflight(req, waitForSlot)
+		if started {
+			// we have started the computation, wait for it, without extra time limit
+			resp := s.waitInflight(ctx, call, 0)
+			return resp, false
+		}
+		// computation is in progress, wait for it
+		log.Println("Work in progress but requested again, waiting; hash", req.Hash)
+		resp := s.waitInflight(ctx, call, s.opts.WorkWaitTimeout)
+		if resp.Error != nil {
+			// non-success (error or timeout), do not count as cache success
+			return resp, false
+		}
+		if resp.Difficulty >= req.Diff {
+			resp.Source = "cache"
+			return resp, true
 		}
-		return resp, true
+		// computed for a lower difficulty, compute again
 	}
-	// We need to call into RPC node for work.
-	resp := getWorkFreshSync(req)
-	return resp, false
+	log.Println("Work in progress repeatedly for lower difficulty, computing directly; hash", req.Hash)
+	// abandoned when the service is stopped, as the in-flight computations
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s.getWorkFreshSync(ctx, req, waitForSlot), false
 }
 
 // If input is account, get frontier first
-func getCachedWorkByAccountOrHash(req WorkRequest) WorkResponse {
+func (s *Service) getCachedWorkByAccountOrHash(ctx context.Context, req WorkRequest) WorkResponse {
 	if req.Input == WorkInputAccount {
-		hash, err := GetFrontierHash(req.Account)
+		hash, err := s.GetFrontierHash(ctx, req.Account)
 		if err != nil {
 			return WorkResponse{Error: err}
 		}
 		req.Hash = hash
 	}
-	resp, _ := getCachedWork(req)
+	resp, _ := s.getCachedWork(ctx, req, false)
 	return resp
 }
 
-var activeWorkOutReqCount int = 0
-
-func decActiveWorkOutReqCount() { activeWorkOutReqCount-- }
-
-// getWorkFreshSync Obtain the work now, by calling into the RPC node
+// getWorkFreshSync Obtain the work now, from the configured work sources
 // When result is obtained, it is added to cache.  Account is optional (may be empty).
-func getWorkFreshSync(req WorkRequest) WorkResponse {
-	activeWorkOutReqCount++
-	defer decActiveWorkOutReqCount()
-
-	statusWorkOutReqCount++
-	if maxOutRequests > 0 {
-		if activeWorkOutReqCount >= maxOutRequests {
-			// too many work requests
-			return WorkResponse{Error: fmt.Errorf("Overload: too many active outgoing work requests %v %v", activeWorkOutReqCount, maxOutRequests)}
+// The request to the sources is abandoned when ctx is cancelled.
+// If waitForSlot is set, it waits for a free slot if the limit of outgoing requests is reached, otherwise it fails.
+func (s *Service) getWorkFreshSync(ctx context.Context, req WorkRequest, waitForSlot bool) WorkResponse {
+	s.metrics.workOutReq.Inc()
+	if waitForSlot {
+		if err := s.workOutLimiter.Acquire(ctx); err != nil {
+			// abandoned while waiting
+			return WorkResponse{Error: err}
 		}
+	} else if !s.workOutLimiter.TryAcquire() {
+		// too many work requests
+		err := fmt.Errorf("%w: too many active outgoing work requests %v %v", ErrOverload, s.workOutLimiter.Active(), s.workOutLimiter.Max())
+		s.notifyWork(WorkEvent{Hash: req.Hash, Account: req.Account, Error: err})
+		return WorkResponse{Error: err}
 	}
+	defer s.workOutLimiter.Release()
 
 	// mark start in cache
-	addToCacheStart(req.Hash)
-	log.Printf("Requesting work from node, reqCount %v  hash %v \n", activeWorkOutReqCount, req.Hash)
+	s.cache.addStart(req.Hash)
+	log.Printf("Requesting work, reqCount %v  hash %v \n", s.workOutLimiter.Active(), req.Hash)
 	// trigger work
 	timeComputed := time.Now().Unix()
-	resp, err, duration := rpcclient.GetWork(req.Hash, req.Diff)
+	resp, err, duration := s.getWorkFromSource(ctx, req)
 	if err != nil {
+		// clear the in-progress marker
+		s.cache.removeComputing(req.Hash)
+		eventErr := err
+		if ctx.Err() != nil {
+			// abandoned by the requester, not a failure of the work
+			eventErr = fmt.Errorf("%w: %v", errWorkAbandoned, err)
+		}
+		s.notifyWork(WorkEvent{Hash: req.Hash, Account: req.Account, Duration: duration, Error: eventErr})
 		return WorkResponse{Error: err}
 	}
 
-	// we have response, add to cache
-	if len(resp.Hash) == 0 {
-		resp.Hash = req.Hash
-	} // for the case if hash is missing in the response
-	addToCache(resp, req.Account, timeComputed)
-	statusWorkOutRespCount++
-	statusWorkOutDurationTotal += duration.Milliseconds()
-	log.Printf("Work resp from node, added to cache; dur %v, req %v, resp %v, \n", duration, req, resp)
+	// we have response (validated), add to cache
+	s.cache.addResult(resp, req.Account, timeComputed)
+	s.metrics.workOutResp.Inc()
+	s.metrics.workOutDurationMs.Add(duration.Milliseconds())
+	s.metrics.workOutDuration.Observe(duration.Seconds())
+	log.Printf("Work resp, added to cache; dur %v, req %v, resp %v, \n", duration, req, resp)
+	s.notifyWork(WorkEvent{resp.Hash, req.Account, resp.Work, resp.Difficulty, resp.Multiplier, duration, nil})
 	return WorkResponse{resp.Hash, resp.Work, resp.Difficulty, resp.Multiplier, "fresh", nil}
 }
 
-func GetFrontierHash(account string) (string, error) {
+// GetFrontierHash Obtain the frontier block hash of an account, from the node
+func (s *Service) GetFrontierHash(ctx context.Context, account string) (string, error) {
 	// get frontier of account
-	hash, err := rpcclient.GetFrontier(account)
+	hash, err := s.client.GetFrontier(ctx, account)
 	if err != nil {
-		return "", errors.New("Could not obtain frontier block for account " + account + ", " + err.Error())
+		return "", fmt.Errorf("Could not obtain frontier block for account %v, %w", account, err)
 	}
 	log.Println("Frontier block of account", account, "is", hash)
 	return hash, nil
 }
 
 // StatusWorkOutReqCount Return the number of outgoing work requests (to node) since start (including currently pending ones)
-func StatusWorkOutReqCount() int { return statusWorkOutReqCount }
+func (s *Service) StatusWorkOutReqCount() int { return int(s.metrics.workOutReq.Value()) }
 
 // StatusWorkOutRespCount Return the number of outgoing work requests responses (from node) since start
-func StatusWorkOutRespCount() int { return statusWorkOutRespCount }
+func (s *Service) StatusWorkOutRespCount() int { return int(s.metrics.workOutResp.Value()) }
 
 // statusWorkOutDurationAvg Return the average duration in ms of the outgoing work requests
-func StatusWorkOutDurationAvg() int {
-	if statusWorkOutRespCount == 0 {
+func (s *Service) StatusWorkOutDurationAvg() int {
+	respCount := s.metrics.workOutResp.Value()
+	if respCount == 0 {
 		return 0
 	}
-	return int(float32(statusWorkOutDurationTotal) / float32(statusWorkOutRespCount))
+	return int(float32(s.metrics.workOutDurationMs.Value()) / float32(respCount))
 }
 
 // StatusWorkInReqCount Return the number of incoming work requests since start
-func StatusWorkInReqCount() int { return statusWorkInReqCount }
+func (s *Service) StatusWorkInReqCount() int { return int(s.metrics.workInReq.Value()) }
 
 // StatusWorkInReqFromCache Return the number of incoming work requests that could be serviced from the cache
-func StatusWorkInReqFromCache() int { return statusWorkInReqFromCache }
+func (s *Service) StatusWorkInReqFromCache() int { return int(s.metrics.workInReqFromCache.Value()) }
 
 // StatusWorkInReqError Return the number of incoming work requests that were returned with error
-func StatusWorkInReqError() int { return statusWorkInReqError }
+func (s *Service) StatusWorkInReqError() int { return int(s.metrics.workInReqError.Value()) }
+
+// StatusActiveWorkOutReqCount Return the number of currently active outgoing work requests
+func (s *Service) StatusActiveWorkOutReqCount() int { return s.workOutLimiter.Active() }
+
+// StatusCacheSize Return the current number of entries in the cache
+func (s *Service) StatusCacheSize() int { return s.cache.size() }
 
-func StatusActiveWorkOutReqCount() int { return activeWorkOutReqCount }
+// StatusCacheBytes Return the estimated memory size of the cache entries, in bytes
+func (s *Service) StatusCacheBytes() int64 {
+	_, bytes := s.cache.evictionStats()
+	return bytes
+}
+
+// StatusCacheEvictions Return the number of entries evicted from the cache due to its size limits, by reason
+func (s *Service) StatusCacheEvictions() CacheEvictionStats {
+	stats, _ := s.cache.evictionStats()
+	return stats
+}
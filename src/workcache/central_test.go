@@ -0,0 +1,104 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type waitResult struct {
+	resp WorkResponse
+	err  error
+}
+
+// startWaitForWork Call WaitForWork in the background; the listener is registered once it returns
+func startWaitForWork(s *Service, hash string) chan waitResult {
+	done := make(chan waitResult, 1)
+	go func() {
+		resp, err := s.WaitForWork(context.Background(), hash, 1, 5*time.Second)
+		done <- waitResult{resp, err}
+	}()
+	// wait for the listener
+	for {
+		s.listenersLock.Lock()
+		n := len(s.listeners)
+		s.listenersLock.Unlock()
+		if n > 0 {
+			return done
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitForWorkSkipsOverloadAndAbandoned(t *testing.T) {
+	s := newTestService(t, 1)
+	defer s.Stop()
+	entry := testEntry(1)
+	done := startWaitForWork(s, entry.hash)
+
+	// other requests for the hash are refused or given up, the wait goes on
+	s.notifyWork(WorkEvent{Hash: entry.hash, Error: fmt.Errorf("%w: too many active outgoing work requests", ErrOverload)})
+	s.notifyWork(WorkEvent{Hash: entry.hash, Error: fmt.Errorf("%w: %v", errWorkAbandoned, context.Canceled)})
+	select {
+	case r := <-done:
+		t.Fatalf("wait ended on overload or abandon, resp %v err %v", r.resp, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.cache.add(entry)
+	s.notifyWork(WorkEvent{Hash: entry.hash, Work: entry.work, Difficulty: entry.difficulty})
+	select {
+	case r := <-done:
+		if r.err != nil || r.resp.Work != entry.work {
+			t.Errorf("resp %v err %v, expected work %v", r.resp, r.err, entry.work)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not ended by the result")
+	}
+}
+
+func TestWaitForWorkComputationError(t *testing.T) {
+	s := newTestService(t, 1)
+	defer s.Stop()
+	hash := testEntry(1).hash
+	done := startWaitForWork(s, hash)
+	sourceErr := errors.New("source failed")
+	s.notifyWork(WorkEvent{Hash: hash, Error: sourceErr})
+	select {
+	case r := <-done:
+		if r.err != sourceErr {
+			t.Errorf("err %v, expected %v", r.err, sourceErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not ended by the error")
+	}
+}
+
+func TestGetCachedWorkRejoinsBounded(t *testing.T) {
+	s := newTestService(t, 0)
+	defer s.Stop()
+	hash := testEntry(1).hash
+	const diff uint64 = 0xff00000000000000
+	// a finished in-flight computation for the hash, for a lower difficulty; it has other waiters, so it stays
+	done := make(chan struct{})
+	close(done)
+	s.inflightCalls[hash] = &inflightCall{hash: hash, done: done, waiters: 1000, cancel: func() {},
+		resp: WorkResponse{Hash: hash, Work: "0000000000000001", Difficulty: 1}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, fromCache := s.getCachedWork(ctx, WorkRequest{WorkInputHash, hash, diff, ""}, false)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if fromCache {
+		t.Error("computed directly, not from cache")
+	}
+	if _, err := ValidateWork(hash, resp.Work, diff); err != nil {
+		t.Error(err)
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
 	"github.com/spf13/viper"
 )
 
@@ -27,12 +31,26 @@ func readConfigIfNeeded() {
 	// no default for "Main.NodeRpc", must be set
 	viper.SetDefault("Main.ListenIpPort", ":7176")
 	viper.SetDefault("Main.CachePeristFileName", "")
+	viper.SetDefault("Main.CachePersistMode", PersistModeFile)
+	viper.SetDefault("Main.CacheCompression", CompressionNone)
 	viper.SetDefault("Main.RestMaxActiveRequests", 500)
 	viper.SetDefault("Main.BackgroundWorkerCount", 4)
 	viper.SetDefault("Main.MaxOutRequests", 0)
 	viper.SetDefault("Main.EnablePregeneration", 1)
+	viper.SetDefault("Main.EnableWebSocket", 0)
 	viper.SetDefault("Main.PregenerationQueueSize", 10000)
 	viper.SetDefault("Main.MaxCacheAgeDays", 30)
+	viper.SetDefault("Main.MaxCacheEntries", 1000000)
+	viper.SetDefault("Main.MaxCacheSizeMB", 0)
+	viper.SetDefault("Main.CpuWorkMode", 0)
+	viper.SetDefault("Main.CpuWorkThreads", runtime.NumCPU())
+	viper.SetDefault("Main.CpuWorkTimeoutSec", 120)
+	viper.SetDefault("Main.WorkSourceStrategy", StrategyFailover)
+	viper.SetDefault("Main.WorkWaitTimeoutSec", 25)
+	viper.SetDefault("Main.RpcTimeoutSec", 15)
+	viper.SetDefault("Main.WorkTimeoutSec", 60)
+	viper.SetDefault("Main.EnableWorkCancel", 1)
+	viper.SetDefault("Main.ShutdownTimeoutSec", 10)
 
 	// read config file
 	viper.SetConfigName(configFileName) // name of config file (without extension)
@@ -88,6 +106,30 @@ func ConfigRestMaxActiveRequests() int {
 	return val
 }
 
+// ConfigCachePersistMode How the cache is persisted: "file" or "kv"
+func ConfigCachePersistMode() string {
+	val := ConfigGetStringWithDefault("Main.CachePersistMode", PersistModeFile)
+	switch val {
+	case PersistModeFile, PersistModeKV:
+		return val
+	default:
+		log.Println("Invalid CachePersistMode value", val)
+		return PersistModeFile
+	}
+}
+
+// ConfigCacheCompression Compression of the cache file: "none", "gzip" or "zstd"
+func ConfigCacheCompression() string {
+	val := ConfigGetStringWithDefault("Main.CacheCompression", CompressionNone)
+	switch val {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return val
+	default:
+		log.Println("Invalid CacheCompression value", val)
+		return CompressionNone
+	}
+}
+
 func ConfigBackgroundWorkerCount() int {
 	val := ConfigGetIntWithDefault("Main.BackgroundWorkerCount", 4)
 	val = int(math.Max(float64(val), float64(2)))
@@ -110,6 +152,10 @@ func ConfigEnablePregeneration() int {
 	return ConfigGetIntWithDefault("Main.EnablePregeneration", 1)
 }
 
+func ConfigEnableWebSocket() int {
+	return ConfigGetIntWithDefault("Main.EnableWebSocket", 0)
+}
+
 func ConfigPregenerationQueueSize() int {
 	val := ConfigGetIntWithDefault("Main.PregenerationQueueSize", 10000)
 	val = int(math.Max(float64(val), float64(0)))
@@ -120,3 +166,153 @@ func ConfigPregenerationQueueSize() int {
 func ConfigMaxCacheAgeDays() int {
 	return ConfigGetIntWithDefault("Main.MaxCacheAgeDays", 30)
 }
+
+func ConfigMaxCacheEntries() int {
+	val := ConfigGetIntWithDefault("Main.MaxCacheEntries", 1000000)
+	val = int(math.Max(float64(val), float64(0)))
+	return val
+}
+
+func ConfigMaxCacheSizeMB() int {
+	val := ConfigGetIntWithDefault("Main.MaxCacheSizeMB", 0)
+	val = int(math.Max(float64(val), float64(0)))
+	return val
+}
+
+func ConfigRpcTimeoutSec() int {
+	val := ConfigGetIntWithDefault("Main.RpcTimeoutSec", 15)
+	val = int(math.Max(float64(val), float64(1)))
+	return val
+}
+
+func ConfigWorkTimeoutSec() int {
+	val := ConfigGetIntWithDefault("Main.WorkTimeoutSec", 60)
+	val = int(math.Max(float64(val), float64(1)))
+	return val
+}
+
+func ConfigEnableWorkCancel() int {
+	return ConfigGetIntWithDefault("Main.EnableWorkCancel", 1)
+}
+
+func ConfigShutdownTimeoutSec() int {
+	val := ConfigGetIntWithDefault("Main.ShutdownTimeoutSec", 10)
+	val = int(math.Max(float64(val), float64(1)))
+	return val
+}
+
+func ConfigWorkWaitTimeoutSec() int {
+	val := ConfigGetIntWithDefault("Main.WorkWaitTimeoutSec", 25)
+	val = int(math.Max(float64(val), float64(1)))
+	return val
+}
+
+func ConfigCpuWorkMode() int {
+	val := ConfigGetIntWithDefault("Main.CpuWorkMode", CpuWorkDisabled)
+	if val < CpuWorkDisabled || val > CpuWorkPrimary {
+		log.Println("Invalid CpuWorkMode value", val)
+		return CpuWorkDisabled
+	}
+	return val
+}
+
+func ConfigCpuWorkThreads() int {
+	val := ConfigGetIntWithDefault("Main.CpuWorkThreads", runtime.NumCPU())
+	val = int(math.Max(float64(val), float64(1)))
+	val = int(math.Min(float64(val), float64(256)))
+	return val
+}
+
+func ConfigCpuWorkTimeoutSec() int {
+	val := ConfigGetIntWithDefault("Main.CpuWorkTimeoutSec", 120)
+	val = int(math.Max(float64(val), float64(1)))
+	return val
+}
+
+// ConfigWorkSources Return the configured work sources, in order of preference.
+// If there are no [[WorkSource]] entries, they are derived from NodeRpcWork and CpuWorkMode.
+func ConfigWorkSources() []WorkSourceConfig {
+	readConfigIfNeeded()
+	var sources []WorkSourceConfig
+	err := viper.UnmarshalKey("WorkSource", &sources)
+	if err != nil {
+		log.Println("Invalid WorkSource config", err.Error())
+		sources = nil
+	}
+	for i := range sources {
+		if sources[i].Type == WorkSourceTypeNode && len(sources[i].Url) == 0 {
+			sources[i].Url = strings.TrimSpace(strings.Split(configNodeRpcWorkOrDefault(), ",")[0])
+		}
+		if (sources[i].Type == WorkSourceTypeNode || sources[i].Type == WorkSourceTypeWorkServer) && sources[i].TimeoutSec == 0 {
+			sources[i].TimeoutSec = ConfigWorkTimeoutSec()
+		}
+		if sources[i].Type == WorkSourceTypeCpu {
+			if sources[i].Threads == 0 {
+				sources[i].Threads = ConfigCpuWorkThreads()
+			}
+			if sources[i].TimeoutSec == 0 {
+				sources[i].TimeoutSec = ConfigCpuWorkTimeoutSec()
+			}
+		}
+	}
+	if len(sources) > 0 {
+		return sources
+	}
+	// legacy config; NodeRpcWork may contain several URLs, separated by comma
+	var nodes []WorkSourceConfig
+	for _, url := range strings.Split(configNodeRpcWorkOrDefault(), ",") {
+		url = strings.TrimSpace(url)
+		if len(url) > 0 {
+			nodes = append(nodes, WorkSourceConfig{Type: WorkSourceTypeNode, Url: url, TimeoutSec: ConfigWorkTimeoutSec()})
+		}
+	}
+	cpu := WorkSourceConfig{Type: WorkSourceTypeCpu, Threads: ConfigCpuWorkThreads(), TimeoutSec: ConfigCpuWorkTimeoutSec()}
+	switch ConfigCpuWorkMode() {
+	case CpuWorkPrimary:
+		return []WorkSourceConfig{cpu}
+	case CpuWorkFallback:
+		return append(nodes, cpu)
+	default:
+		return nodes
+	}
+}
+
+// ConfigWorkSourceStrategy How to select among several work sources: failover, roundrobin, leastloaded, fastest, race
+func ConfigWorkSourceStrategy() string {
+	val := ConfigGetStringWithDefault("Main.WorkSourceStrategy", StrategyFailover)
+	switch val {
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastLoaded, StrategyFastest, StrategyRace:
+		return val
+	default:
+		log.Println("Invalid WorkSourceStrategy value", val)
+		return StrategyFailover
+	}
+}
+
+// ConfigServiceOptions Return the work cache options from the configuration, with the given rpc client
+func ConfigServiceOptions(client *rpcclient.Client) Options {
+	return Options{
+		Client:                 client,
+		WorkSources:            ConfigWorkSources(),
+		WorkSourceStrategy:     ConfigWorkSourceStrategy(),
+		EnableWorkCancel:       ConfigEnableWorkCancel() >= 1,
+		CachePersistFileName:   ConfigGetString("Main.CachePeristFileName"),
+		CachePersistMode:       ConfigCachePersistMode(),
+		CacheCompression:       ConfigCacheCompression(),
+		BackgroundWorkerCount:  ConfigBackgroundWorkerCount(),
+		MaxOutRequests:         ConfigMaxOutRequests(),
+		PregenerationQueueSize: ConfigPregenerationQueueSize(),
+		MaxCacheAgeDays:        ConfigMaxCacheAgeDays(),
+		MaxCacheEntries:        ConfigMaxCacheEntries(),
+		MaxCacheBytes:          int64(ConfigMaxCacheSizeMB()) * 1024 * 1024,
+		WorkWaitTimeout:        time.Duration(ConfigWorkWaitTimeoutSec()) * time.Second,
+	}
+}
+
+func configNodeRpcWorkOrDefault() string {
+	url := ConfigNodeRpcWork()
+	if len(url) == 0 {
+		url = ConfigNodeRpc()
+	}
+	return url
+}
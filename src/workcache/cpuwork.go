@@ -0,0 +1,98 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// CpuWorkDisabled Local CPU work generation is not used (legacy config, see WorkSource)
+	CpuWorkDisabled = 0
+	// CpuWorkFallback Local CPU work generation is used if the node fails
+	CpuWorkFallback = 1
+	// CpuWorkPrimary Local CPU work generation is used instead of the node
+	CpuWorkPrimary = 2
+)
+
+// number of nonces tried between checks for cancellation
+const cpuWorkBatch = 1 << 14
+
+// GenerateWorkCpu Compute work for a hash locally, on CPU, using several goroutines.
+// Runs until work reaching the difficulty is found, or ctx is cancelled.
+// Returns the work value (hex string) and its actual difficulty.
+func GenerateWorkCpu(ctx context.Context, hash string, diff uint64, threads int) (string, uint64, error) {
+	hashBytes, err := parseHash(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	if diff == 0 {
+		diff = BaseDifficulty
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	var randBytes [8]byte
+	_, err = rand.Read(randBytes[:])
+	if err != nil {
+		return "", 0, err
+	}
+	start := binary.LittleEndian.Uint64(randBytes[:])
+
+	found := make(chan uint64, threads)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		// each thread starts from a different, distant point
+		go func(nonce uint64) {
+			defer wg.Done()
+			cpuWorkSearch(ctx, nonce, hashBytes, diff, found, done)
+		}(start + uint64(i)<<56)
+	}
+
+	var work uint64
+	select {
+	case work = <-found:
+		close(done)
+	case <-ctx.Done():
+		close(done)
+		wg.Wait()
+		return "", 0, fmt.Errorf("CPU work generation cancelled, %v", ctx.Err())
+	}
+	wg.Wait()
+	return fmt.Sprintf("%016x", work), workValue(work, hashBytes), nil
+}
+
+// cpuWorkSearch Search for work on one thread, starting from nonce
+func cpuWorkSearch(ctx context.Context, nonce uint64, hashBytes []byte, diff uint64, found chan<- uint64, done <-chan struct{}) {
+	h, _ := blake2b.New(8, nil)
+	var workBytes [8]byte
+	var sum [8]byte
+	for {
+		for i := 0; i < cpuWorkBatch; i++ {
+			binary.LittleEndian.PutUint64(workBytes[:], nonce)
+			h.Reset()
+			h.Write(workBytes[:])
+			h.Write(hashBytes)
+			if binary.LittleEndian.Uint64(h.Sum(sum[:0])) >= diff {
+				found <- nonce
+				return
+			}
+			nonce++
+		}
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
@@ -7,39 +7,40 @@ import (
 	"time"
 )
 
-var housekeepingPeriodSec int = 1 * 60
-
-var lastCacheSaveTime int64 = 0
-var lastAgeCheckTime int64 = 0
-
-// Housekeeping is executed periodically.  It incudes:
-// - Saving the cachefile (if it has changed since last time)
-func housekeepingCycle() {
-	lastCacheSaveTime = CacheUpdateTime()
-	lastAgeCheckTime = CacheUpdateTime()
+// Housekeeping is executed periodically, until the service is stopped.  It incudes:
+// - Removing old entries (if the cache has changed since last time)
+// - Checkpoint of the cache persistence (e.g. compacting the journal into a new cachefile)
+// - Saving the pregeneration queue (if it has changed since last time)
+func (s *Service) housekeepingCycle() {
+	defer s.wg.Done()
+	lastAgeCheckTime := s.cache.lastUpdate()
+	ticker := time.NewTicker(s.opts.HousekeepingPeriod)
+	defer ticker.Stop()
 	for {
-		doHousekeepingCycle()
-		time.Sleep(time.Second * time.Duration(housekeepingPeriodSec))
+		s.doHousekeepingCycle(&lastAgeCheckTime)
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
 	}
 }
 
-func doHousekeepingCycle() {
-	cacheUpdateTime := CacheUpdateTime()
+func (s *Service) doHousekeepingCycle(lastAgeCheckTime *int64) {
+	cacheUpdateTime := s.cache.lastUpdate()
 
-	if maxCacheAgeDays > 0 {
-		if cacheUpdateTime > lastAgeCheckTime {
-			log.Printf("Running cache aging (%v %v)\n", lastAgeCheckTime, cacheUpdateTime)
-			RemoveOldEntries(float64(maxCacheAgeDays))
-			lastAgeCheckTime = cacheUpdateTime
+	if s.opts.MaxCacheAgeDays > 0 {
+		if cacheUpdateTime > *lastAgeCheckTime {
+			log.Printf("Running cache aging (%v %v)\n", *lastAgeCheckTime, cacheUpdateTime)
+			s.cache.removeOld(float64(s.opts.MaxCacheAgeDays))
+			*lastAgeCheckTime = cacheUpdateTime
 		}
 	}
 
-	if isPersistToFileEnabled() {
-		origLastCacheSaveTime := lastCacheSaveTime
-		if cacheUpdateTime > lastCacheSaveTime {
-			SaveCache()
-			lastCacheSaveTime = cacheUpdateTime
-			log.Printf("Cache saved, %v %v \n", origLastCacheSaveTime, cacheUpdateTime)
+	if s.isPersistToFileEnabled() {
+		s.checkpointCache(false)
+		if s.pregenerateJobs.changes() != s.queueSavedChanges {
+			s.SaveQueue()
 		}
 	}
 }
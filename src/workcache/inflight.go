@@ -0,0 +1,126 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// inflightCall A work computation in progress; all callers for the same hash wait on the same call.
+// The computation runs on its own context, which is cancelled when all waiters are gone.
+type inflightCall struct {
+	hash string
+	// closed when the result is available
+	done chan struct{}
+	resp WorkResponse
+	// number of callers waiting for the result, protected by the inflight lock of the service
+	waiters int
+	// cancels the computation
+	cancel context.CancelFunc
+}
+
+// ErrServiceStopped Returned for requests arriving after the service has been stopped
+var ErrServiceStopped = errors.New("Work cache service is stopped")
+
+// ErrWaitTimeout Returned if the result of an in-progress computation did not arrive in time
+var ErrWaitTimeout = errors.New("Timeout in work generation")
+
+// ErrOverload Returned (wrapped) if a work request cannot be started due to the limits on outgoing requests
+var ErrOverload = errors.New("Overload")
+
+// errWorkAbandoned Error of the work events of computations abandoned by their requester
+var errWorkAbandoned = errors.New("Work abandoned")
+
+// ErrNoWorkSource Returned if there is no work source configured
+var ErrNoWorkSource = errors.New("No work source available")
+
+// joinInflight Join the in-flight computation for the hash, as a waiter.  If there is none, a new one is started
+// (in the background), and true is returned.  The caller must call leaveInflight when done waiting.
+// The computation is cancelled when the service is stopped.  For waitForSlot see getWorkFreshSync.
+func (s *Service) joinInflight(req WorkRequest, waitForSlot bool) (*inflightCall, bool) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+	if call, ok := s.inflightCalls[req.Hash]; ok {
+		call.waiters++
+		return call, false
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	call := &inflightCall{hash: req.Hash, done: make(chan struct{}), waiters: 1, cancel: cancel}
+	if ctx.Err() != nil {
+		// service is stopped, do not start anything
+		call.resp = WorkResponse{Error: ErrServiceStopped}
+		close(call.done)
+		return call, true
+	}
+	s.inflightCalls[req.Hash] = call
+	s.wg.Add(1)
+	go s.runInflight(ctx, req, call, waitForSlot)
+	return call, true
+}
+
+// runInflight Compute the work, store the result, and wake up all waiters
+func (s *Service) runInflight(ctx context.Context, req WorkRequest, call *inflightCall, waitForSlot bool) {
+	defer s.wg.Done()
+	resp := s.getWorkFreshSync(ctx, req, waitForSlot)
+	s.inflightLock.Lock()
+	if s.inflightCalls[call.hash] == call {
+		delete(s.inflightCalls, call.hash)
+	}
+	s.inflightLock.Unlock()
+	call.cancel()
+	call.resp = resp
+	close(call.done)
+}
+
+// leaveInflight Stop waiting for the call.  If this was the last waiter, the computation is abandoned:
+// its context is cancelled, the work sources stop (and send work_cancel) for this computation only.
+func (s *Service) leaveInflight(call *inflightCall) {
+	s.inflightLock.Lock()
+	call.waiters--
+	abandon := call.waiters <= 0
+	if abandon && s.inflightCalls[call.hash] == call {
+		// later requests should start a new computation
+		delete(s.inflightCalls, call.hash)
+	}
+	s.inflightLock.Unlock()
+	if !abandon {
+		return
+	}
+	select {
+	case <-call.done:
+		// finished already
+	default:
+		log.Println("No more waiters, abandoning work computation; hash", call.hash)
+		call.cancel()
+	}
+}
+
+// isInflight Return true if a computation is in progress for the hash
+func (s *Service) isInflight(hash string) bool {
+	s.inflightLock.Lock()
+	_, ok := s.inflightCalls[hash]
+	s.inflightLock.Unlock()
+	return ok
+}
+
+// waitInflight Wait for the result of an in-flight call, until ctx is done, or until timeout (if not 0)
+func (s *Service) waitInflight(ctx context.Context, call *inflightCall, timeout time.Duration) WorkResponse {
+	defer s.leaveInflight(call)
+	var timeoutC <-chan time.Time = nil
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+	select {
+	case <-call.done:
+		return call.resp
+	case <-timeoutC:
+		return WorkResponse{Error: ErrWaitTimeout}
+	case <-ctx.Done():
+		return WorkResponse{Error: ctx.Err()}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Limiter Limits the number of concurrent activities (requests, etc.), safe for concurrent use
+type Limiter struct {
+	// max allowed concurrent count, 0 means no limit; not changed after creation
+	max    int64
+	active int64
+	// closed (and cleared) when a slot may have become free, to wake up waiting Acquire calls; nil if nobody waits
+	released     chan struct{}
+	releasedLock sync.Mutex
+}
+
+// NewLimiter Create a limiter, allowing max concurrent activities; 0 means no limit
+func NewLimiter(max int) *Limiter {
+	return &Limiter{max: int64(max)}
+}
+
+// TryAcquire Reserve a slot if the limit is not reached; return false if it is reached.
+// On success, Release must be called at the end.
+func (l *Limiter) TryAcquire() bool {
+	for {
+		active := atomic.LoadInt64(&l.active)
+		if l.max > 0 && active >= l.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+// Acquire Reserve a slot, waiting for one if the limit is reached; returns error if ctx is done meanwhile.
+// On success, Release must be called at the end.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	for {
+		// taken before trying, so a release after a failed try is not missed
+		l.releasedLock.Lock()
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.releasedLock.Unlock()
+		if l.TryAcquire() {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release Free a slot obtained by TryAcquire or Acquire
+func (l *Limiter) Release() {
+	atomic.AddInt64(&l.active, -1)
+	l.wakeWaiters()
+}
+
+// wakeWaiters Wake up the waiting Acquire calls, to try again
+func (l *Limiter) wakeWaiters() {
+	l.releasedLock.Lock()
+	defer l.releasedLock.Unlock()
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+// Active Return the current number of activities
+func (l *Limiter) Active() int {
+	return int(atomic.LoadInt64(&l.active))
+}
+
+// Max Return the limit, 0 means no limit
+func (l *Limiter) Max() int {
+	return int(l.max)
+}
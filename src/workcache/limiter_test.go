@@ -0,0 +1,133 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterConcurrent(t *testing.T) {
+	const max = 4
+	l := NewLimiter(max)
+	var holders int64
+	var exceeded int64
+	var acquired int64
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				if !l.TryAcquire() {
+					continue
+				}
+				atomic.AddInt64(&acquired, 1)
+				if n := atomic.AddInt64(&holders, 1); n > max {
+					atomic.AddInt64(&exceeded, 1)
+				}
+				if l.Active() > l.Max() {
+					atomic.AddInt64(&exceeded, 1)
+				}
+				atomic.AddInt64(&holders, -1)
+				l.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	if exceeded > 0 {
+		t.Errorf("limit exceeded %v times", exceeded)
+	}
+	if acquired == 0 {
+		t.Error("no slot acquired")
+	}
+	if l.Active() != 0 {
+		t.Errorf("active %v after all released", l.Active())
+	}
+}
+
+func TestLimiterNoLimit(t *testing.T) {
+	l := NewLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !l.TryAcquire() {
+			t.Fatal("acquire failed without limit")
+		}
+	}
+	if l.Active() != 100 {
+		t.Errorf("active %v, expected 100", l.Active())
+	}
+}
+
+func TestLimiterAcquireWaits(t *testing.T) {
+	l := NewLimiter(1)
+	if !l.TryAcquire() {
+		t.Fatal("acquire failed")
+	}
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.Acquire(context.Background()) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired while the slot is taken, err %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not acquired after release")
+	}
+	if l.Active() != 1 {
+		t.Errorf("active %v, expected 1", l.Active())
+	}
+}
+
+func TestLimiterAcquireCancelled(t *testing.T) {
+	l := NewLimiter(1)
+	l.TryAcquire()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err %v, expected deadline exceeded", err)
+	}
+	if l.Active() != 1 {
+		t.Errorf("active %v, expected 1", l.Active())
+	}
+}
+
+func TestLimiterAcquireConcurrent(t *testing.T) {
+	const max = 3
+	l := NewLimiter(max)
+	var holders int64
+	var exceeded int64
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := l.Acquire(context.Background()); err != nil {
+					t.Error(err)
+					return
+				}
+				if n := atomic.AddInt64(&holders, 1); n > max {
+					atomic.AddInt64(&exceeded, 1)
+				}
+				atomic.AddInt64(&holders, -1)
+				l.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	if exceeded > 0 {
+		t.Errorf("limit exceeded %v times", exceeded)
+	}
+	if l.Active() != 0 {
+		t.Errorf("active %v after all released", l.Active())
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"github.com/catenocrypt/nano-work-cache/metrics"
+)
+
+// serviceMetrics The metrics of a service, in their own registry
+type serviceMetrics struct {
+	registry           *metrics.Registry
+	workInReq          *metrics.Counter
+	workInReqFromCache *metrics.Counter
+	workInReqError     *metrics.Counter
+	workOutReq         *metrics.Counter
+	workOutResp        *metrics.Counter
+	workOutDurationMs  *metrics.Counter
+	workOutDuration    *metrics.Histogram
+	pregenEnqueued     *metrics.Counter
+	pregenDropped      *metrics.Counter
+}
+
+func newServiceMetrics(s *Service) *serviceMetrics {
+	r := metrics.NewRegistry()
+	m := &serviceMetrics{
+		registry:           r,
+		workInReq:          r.NewCounter("nano_work_cache_work_in_requests_total", "Incoming work requests"),
+		workInReqFromCache: r.NewCounter("nano_work_cache_work_in_cache_hits_total", "Incoming work requests served from the cache"),
+		workInReqError:     r.NewCounter("nano_work_cache_work_in_errors_total", "Incoming work requests returned with error"),
+		workOutReq:         r.NewCounter("nano_work_cache_work_out_requests_total", "Outgoing work requests, to work sources"),
+		workOutResp:        r.NewCounter("nano_work_cache_work_out_responses_total", "Successful outgoing work requests"),
+		workOutDurationMs:  r.NewCounter("nano_work_cache_work_out_duration_ms_total", "Total duration of successful outgoing work requests, in ms"),
+		workOutDuration:    r.NewHistogram("nano_work_cache_work_out_duration_seconds", "Duration of successful outgoing work requests", metrics.DefaultDurationBuckets),
+		pregenEnqueued:     r.NewCounter("nano_work_cache_pregeneration_enqueued_total", "Pregeneration requests enqueued"),
+		pregenDropped:      r.NewCounter("nano_work_cache_pregeneration_dropped_total", "Pregeneration requests dropped, due to full queue"),
+	}
+	r.NewGaugeFunc("nano_work_cache_cache_size", "Number of entries in the cache",
+		func() float64 { return float64(s.StatusCacheSize()) })
+	r.NewGaugeFunc("nano_work_cache_cache_bytes", "Estimated memory size of the cache entries, in bytes",
+		func() float64 { return float64(s.StatusCacheBytes()) })
+	r.NewCounterFunc("nano_work_cache_cache_evicted_served_total", "Cache entries evicted due to size limits, already served",
+		func() float64 { return float64(s.StatusCacheEvictions().Served) })
+	r.NewCounterFunc("nano_work_cache_cache_evicted_stale_total", "Cache entries evicted due to size limits, of stale frontiers",
+		func() float64 { return float64(s.StatusCacheEvictions().StaleFrontier) })
+	r.NewCounterFunc("nano_work_cache_cache_evicted_lru_total", "Cache entries evicted due to size limits, least recently used",
+		func() float64 { return float64(s.StatusCacheEvictions().LRU) })
+	r.NewGaugeFunc("nano_work_cache_pregeneration_queue_length", "Number of pregeneration requests waiting in the queue",
+		func() float64 { return float64(s.StatusPregenerQueueSize()) })
+	r.NewGaugeFunc("nano_work_cache_work_out_active", "Number of active outgoing work requests",
+		func() float64 { return float64(s.StatusActiveWorkOutReqCount()) })
+	r.NewGaugeFunc("nano_work_cache_network_difficulty", "Current network difficulty",
+		func() float64 { return float64(s.client.GetDifficultyLast()) })
+	return m
+}
@@ -0,0 +1,58 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"errors"
+	"time"
+)
+
+// WorkEvent Result of a work computation: valid work stored in the cache, or an error
+type WorkEvent struct {
+	Hash string
+	// Account of the block, if known; may be empty
+	Account    string
+	Work       string
+	Difficulty uint64
+	Multiplier float64
+	// Duration of the computation
+	Duration time.Duration
+	Error    error
+}
+
+// IsWaitableError Return true if the error of a work event does not concern the work itself: the computation
+// was not started due to overload, or was abandoned by its requester; another one may still provide the work
+func IsWaitableError(err error) bool {
+	return errors.Is(err, ErrOverload) || errors.Is(err, errWorkAbandoned)
+}
+
+// WorkListener Function called on work results.  It is called from the computing goroutine, it must not block.
+type WorkListener func(WorkEvent)
+
+// AddWorkListener Register a function to be called on each work result (work stored in the cache, or failed computation).
+// Returns a function to remove the listener.
+func (s *Service) AddWorkListener(listener WorkListener) func() {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+	id := s.nextListenerId
+	s.nextListenerId++
+	s.listeners[id] = listener
+	return func() {
+		s.listenersLock.Lock()
+		defer s.listenersLock.Unlock()
+		delete(s.listeners, id)
+	}
+}
+
+// notifyWork Call the listeners with a work result
+func (s *Service) notifyWork(event WorkEvent) {
+	s.listenersLock.Lock()
+	listeners := make([]WorkListener, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	s.listenersLock.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
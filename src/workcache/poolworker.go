@@ -3,54 +3,57 @@
 package workcache
 
 import (
-	//"fmt"
 	"log"
 	"time"
 )
 
-// Background generate jobs, with low priority.  Size is large.
-var pregenerateJobsMaxSize int = 0
-var pregenerateJobs chan WorkRequest = nil
-
-func InitQueue() {
-	pregenerateJobsMaxSize = ConfigPregenerationQueueSize()
-	pregenerateJobs = make(chan WorkRequest, pregenerateJobsMaxSize)
-}
-
-func addPregenerateRequest(req WorkRequest) {
-	if len(pregenerateJobs) >= pregenerateJobsMaxSize-2 {
-		// queue is full, do not put any more (to avoid blocking)
-		log.Printf("WARNING: Pregeneration queue is full, not enqueuing any more, %v\n", len(pregenerateJobs))
+func (s *Service) addPregenerateRequest(req WorkRequest) {
+	if s.ctx.Err() != nil {
+		// stopped, not processed any more
+		s.metrics.pregenDropped.Inc()
+		return
+	}
+	if !s.pregenerateJobs.push(req) {
+		// queue is full, do not put any more
+		log.Printf("WARNING: Pregeneration queue is full, not enqueuing any more, %v\n", s.pregenerateJobs.len())
+		s.metrics.pregenDropped.Inc()
 		return
 	}
-	pregenerateJobs <- req
+	s.metrics.pregenEnqueued.Inc()
 }
 
-func doProcess(name int) {
+func (s *Service) doProcess(name int) {
+	defer s.wg.Done()
 	for {
-		// wait on queue, with periodical timeout
-		ticker := time.NewTicker(20 * time.Second)
-		defer ticker.Stop()
-
-		select {
-		case preJob := <-pregenerateJobs:
-			//log.Printf("Worker %v : pregenerate job", name)
-			resp := getCachedWorkByAccountOrHash(preJob)
-			if resp.Error != nil {
-				log.Printf("WARNING: Could not process request, sleeping to slow queue, %v \n", resp.Error)
-				time.Sleep(20 * time.Second)
+		preJob, ok := s.pregenerateJobs.pop(s.ctx)
+		if !ok {
+			// service stopped
+			return
+		}
+		//log.Printf("Worker %v : pregenerate job", name)
+		resp := s.getCachedWorkByAccountOrHash(s.ctx, preJob)
+		if resp.Error != nil {
+			if s.ctx.Err() != nil {
+				// interrupted by stop, keep it for next time
+				s.pregenerateJobs.pushFront(preJob)
+				return
+			}
+			log.Printf("WARNING: Could not process request, sleeping to slow queue, %v \n", resp.Error)
+			select {
+			case <-time.After(20 * time.Second):
+			case <-s.ctx.Done():
 			}
-		case <-ticker.C:
-			// timeout, idle loop
 		}
 	}
 }
 
-func startWorkers(backgroundWorkerCount int) {
+func (s *Service) startWorkers(backgroundWorkerCount int) {
 	for i := 0; i < backgroundWorkerCount; i++ {
-		go doProcess(i)
+		s.wg.Add(1)
+		go s.doProcess(i)
 	}
 	log.Printf("%v pool workers started\n", backgroundWorkerCount)
 }
 
-func StatusPregenerQueueSize() int { return len(pregenerateJobs) }
+// StatusPregenerQueueSize Return the number of pregeneration requests waiting in the queue
+func (s *Service) StatusPregenerQueueSize() int { return s.pregenerateJobs.len() }
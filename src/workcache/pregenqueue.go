@@ -0,0 +1,221 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pregenerateQueue FIFO queue of pregeneration requests, safe for concurrent use.
+// Unlike a channel, its content can be listed, for persistence.
+type pregenerateQueue struct {
+	lock    sync.Mutex
+	items   []WorkRequest
+	maxSize int
+	// signalled when an item is added
+	notify chan struct{}
+	// incremented on every change, to know if it has to be saved
+	changeCount int64
+}
+
+func newPregenerateQueue(maxSize int) *pregenerateQueue {
+	return &pregenerateQueue{maxSize: maxSize, notify: make(chan struct{}, 1)}
+}
+
+// push Add a request at the end; returns false if the queue is full
+func (q *pregenerateQueue) push(req WorkRequest) bool {
+	q.lock.Lock()
+	if len(q.items) >= q.maxSize-2 {
+		q.lock.Unlock()
+		return false
+	}
+	q.items = append(q.items, req)
+	q.changeCount++
+	q.lock.Unlock()
+	q.signal()
+	return true
+}
+
+// pushFront Put back a request at the front, regardless of the size limit (for requests interrupted by stop)
+func (q *pregenerateQueue) pushFront(req WorkRequest) {
+	q.lock.Lock()
+	q.items = append([]WorkRequest{req}, q.items...)
+	q.changeCount++
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *pregenerateQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+		// already signalled
+	}
+}
+
+// pop Take the first request; blocks until there is one, or ctx is done (false is returned then)
+func (q *pregenerateQueue) pop(ctx context.Context) (WorkRequest, bool) {
+	for {
+		q.lock.Lock()
+		if len(q.items) > 0 {
+			req := q.items[0]
+			q.items = q.items[1:]
+			q.changeCount++
+			remaining := len(q.items)
+			q.lock.Unlock()
+			if remaining > 0 {
+				// wake up another worker
+				q.signal()
+			}
+			return req, true
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return WorkRequest{}, false
+		}
+	}
+}
+
+func (q *pregenerateQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// snapshot Return a copy of the waiting requests, and the change counter
+func (q *pregenerateQueue) snapshot() ([]WorkRequest, int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]WorkRequest{}, q.items...), q.changeCount
+}
+
+func (q *pregenerateQueue) changes() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.changeCount
+}
+
+// File of the persisted pregeneration queue, next to the cache file
+func queueFileName(cacheFileName string) string {
+	return cacheFileName + ".queue"
+}
+
+// Convert a request to a single-line string representation
+func requestToString(req WorkRequest) string {
+	if req.Input == WorkInputAccount {
+		return fmt.Sprintf("account %v", padString(req.Account))
+	}
+	return fmt.Sprintf("hash %v %x %v", padString(req.Hash), req.Diff, padString(req.Account))
+}
+
+// Parse a request from a single-line string representation, see requestToString
+func requestLoadFromString(line string, req *WorkRequest) bool {
+	tokens := strings.Split(line, " ")
+	switch {
+	case len(tokens) == 2 && tokens[0] == "account" && tokens[1] != "_":
+		*req = WorkRequest{WorkInputAccount, "", 0, tokens[1]}
+		return true
+	case len(tokens) == 4 && tokens[0] == "hash" && tokens[1] != "_":
+		diff, err := strconv.ParseUint(tokens[2], 16, 64)
+		if err != nil {
+			return false
+		}
+		account := tokens[3]
+		if account == "_" {
+			account = ""
+		}
+		*req = WorkRequest{WorkInputHash, tokens[1], diff, account}
+		return true
+	}
+	return false
+}
+
+// saveQueueToFile Save the waiting pregeneration requests to the given file
+func saveQueueToFile(reqs []WorkRequest, filename string) error {
+	return writeFileAtomic(filename, false, func(file *os.File) error {
+		writer := bufio.NewWriter(file)
+		for _, req := range reqs {
+			fmt.Fprintln(writer, requestToString(req))
+		}
+		return writer.Flush()
+	})
+}
+
+// loadQueueFromFile Read pregeneration requests from the given file; a missing file means an empty queue
+func loadQueueFromFile(filename string) ([]WorkRequest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var reqs []WorkRequest
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var req WorkRequest
+		if requestLoadFromString(scanner.Text(), &req) {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, scanner.Err()
+}
+
+// SaveQueue Save the waiting pregeneration requests, next to the cache file (if persistence is configured)
+func (s *Service) SaveQueue() {
+	if !s.isPersistToFileEnabled() {
+		return
+	}
+	reqs, changes := s.pregenerateJobs.snapshot()
+	err := saveQueueToFile(reqs, queueFileName(s.opts.CachePersistFileName))
+	if err != nil {
+		log.Println("WARNING", "Could not save pregeneration queue;", err.Error())
+		return
+	}
+	s.queueSavedChanges = changes
+	log.Printf("Pregeneration queue saved, %v requests\n", len(reqs))
+}
+
+// LoadQueue Load the saved pregeneration requests, and enqueue them.
+// Requests already in the cache, and duplicates, are omitted.
+func (s *Service) LoadQueue() {
+	if !s.isPersistToFileEnabled() {
+		return
+	}
+	filename := queueFileName(s.opts.CachePersistFileName)
+	reqs, err := loadQueueFromFile(filename)
+	if err != nil {
+		log.Println("WARNING", "Could not load pregeneration queue;", err.Error())
+	}
+	seen := make(map[string]bool, len(reqs))
+	cnt := 0
+	for _, req := range reqs {
+		key := requestToString(req)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if req.Input == WorkInputHash {
+			if found, _, _ := s.getWorkFromCache(req); found {
+				continue
+			}
+		}
+		if s.pregenerateJobs.push(req) {
+			cnt++
+		}
+	}
+	s.queueSavedChanges = s.pregenerateJobs.changes()
+	if len(reqs) > 0 {
+		log.Printf("Pregeneration queue loaded from file %v, %v requests read, %v enqueued\n", filename, len(reqs), cnt)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/metrics"
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+// Options Settings of a Service.  Client is mandatory, zero values of the others mean defaults or disabled.
+type Options struct {
+	// Client for the node RPC; used for frontiers and difficulty
+	Client *rpcclient.Client
+	// Work sources, in order of preference
+	WorkSources []WorkSourceConfig
+	// How to select among the work sources, see StrategyFailover etc.; default failover
+	WorkSourceStrategy string
+	// If set, work_cancel is sent to nodes and work servers for abandoned generations
+	EnableWorkCancel bool
+	// File to persist the cache to; empty means no persistence
+	CachePersistFileName string
+	// How the cache is persisted: PersistModeFile (default) or PersistModeKV
+	CachePersistMode string
+	// Compression of the cache file, in PersistModeFile: CompressionNone (default), CompressionGzip or CompressionZstd
+	CacheCompression string
+	// Number of workers processing the pregeneration queue; default 4
+	BackgroundWorkerCount int
+	// Max number of concurrent outgoing work requests; 0 means no limit
+	MaxOutRequests int
+	// Capacity of the pregeneration queue; default 10000
+	PregenerationQueueSize int
+	// Entries older than this are removed from the cache; 0 means no limit
+	MaxCacheAgeDays int
+	// Max number of entries in the cache, above it entries are evicted; 0 means no limit
+	MaxCacheEntries int
+	// Max estimated memory size of the cache entries, in bytes, above it entries are evicted; 0 means no limit
+	MaxCacheBytes int64
+	// Number of shards of the cache, each with its own lock; default 32.  The limits apply to each shard proportionally.
+	CacheShardCount int
+	// Max time to wait for a computation started by another request; default 25 s
+	WorkWaitTimeout time.Duration
+	// Period of saving and aging the cache; default 1 min
+	HousekeepingPeriod time.Duration
+}
+
+// Service A work cache instance: the cache, the work sources, the pregeneration queue and its workers.
+// Several independent instances may exist in one process.
+type Service struct {
+	opts           Options
+	client         *rpcclient.Client
+	cache          *workCache
+	pool           *workPool
+	workOutLimiter *Limiter
+	metrics        *serviceMetrics
+	// persistence of the cache, nil if not configured
+	backend cacheBackend
+
+	// Computations in progress, key is hash
+	inflightCalls map[string]*inflightCall
+	inflightLock  sync.Mutex
+
+	// Listeners of work results, see AddWorkListener
+	listeners      map[int64]WorkListener
+	listenersLock  sync.Mutex
+	nextListenerId int64
+
+	// Background generate jobs, with low priority.  Size is large.
+	pregenerateJobs *pregenerateQueue
+	// change counter of the queue at the last save
+	queueSavedChanges int64
+
+	// Context of the running service, cancelled on Stop; parent of all background computations
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	started  bool
+	stopOnce sync.Once
+}
+
+// NewService Create a service with the given options.  It has to be started with Start.
+func NewService(opts Options) (*Service, error) {
+	if opts.Client == nil {
+		return nil, errors.New("Missing rpc client in work cache options")
+	}
+	if len(opts.WorkSourceStrategy) == 0 {
+		opts.WorkSourceStrategy = StrategyFailover
+	}
+	if opts.BackgroundWorkerCount <= 0 {
+		opts.BackgroundWorkerCount = 4
+	}
+	if opts.PregenerationQueueSize <= 0 {
+		opts.PregenerationQueueSize = 10000
+	}
+	if opts.WorkWaitTimeout <= 0 {
+		opts.WorkWaitTimeout = 25 * time.Second
+	}
+	if opts.CacheShardCount <= 0 {
+		opts.CacheShardCount = defaultCacheShardCount
+	}
+	if opts.HousekeepingPeriod <= 0 {
+		opts.HousekeepingPeriod = 1 * time.Minute
+	}
+	s := &Service{
+		opts:            opts,
+		client:          opts.Client,
+		cache:           newWorkCache(opts.CacheShardCount, opts.MaxCacheEntries, opts.MaxCacheBytes),
+		pool:            newWorkPool(opts.WorkSources, opts.WorkSourceStrategy, opts.EnableWorkCancel),
+		workOutLimiter:  NewLimiter(opts.MaxOutRequests),
+		inflightCalls:   map[string]*inflightCall{},
+		listeners:       map[int64]WorkListener{},
+		pregenerateJobs: newPregenerateQueue(opts.PregenerationQueueSize),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.metrics = newServiceMetrics(s)
+	return s, nil
+}
+
+// Start Load the cache, start the background workers and housekeeping.  Does not block.
+// The service stops when ctx is done, or on Stop.
+func (s *Service) Start(ctx context.Context) error {
+	if s.started {
+		return errors.New("Work cache service already started")
+	}
+	if s.ctx.Err() != nil {
+		return errors.New("Work cache service already stopped")
+	}
+	err := s.openBackend()
+	if err != nil {
+		return err
+	}
+	s.started = true
+	s.LoadCache()
+	if s.opts.MaxCacheAgeDays > 0 {
+		s.cache.removeOld(float64(s.opts.MaxCacheAgeDays))
+	}
+	s.LoadQueue()
+	s.startWorkers(s.opts.BackgroundWorkerCount)
+	s.wg.Add(1)
+	go s.housekeepingCycle()
+	// stop together with the parent context; not in wg, as Stop waits for wg
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.ctx.Done():
+		}
+	}()
+	return nil
+}
+
+// Stop Stop the background workers and housekeeping, and cancel ongoing computations.  Waits for them to finish,
+// then saves the cache and the pending pregeneration requests a last time.
+// Should be called after the API has stopped accepting requests.
+// May be called several times, also concurrently (e.g. on ctx done and explicitly); all calls return when stopped.
+func (s *Service) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Service) stop() {
+	s.shutdown()
+	s.wg.Wait()
+	if s.started {
+		// save only what was loaded and computed; a never started service would overwrite the files
+		s.SaveCache()
+		s.SaveQueue()
+		s.closeBackend()
+	}
+	log.Println("Work cache service stopped")
+}
+
+// shutdown Cancel the service context.  Done under the inflight lock, so no new computation is started afterwards.
+func (s *Service) shutdown() {
+	s.inflightLock.Lock()
+	s.cancel()
+	s.inflightLock.Unlock()
+}
+
+// Client Return the rpc client used by the service
+func (s *Service) Client() *rpcclient.Client { return s.client }
+
+// Metrics Return the registry with the metrics of the service
+func (s *Service) Metrics() *metrics.Registry { return s.metrics.registry }
@@ -0,0 +1,82 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+// newPersistedTestService Create a service persisting its cache to the file, and start it with ctx
+func newPersistedTestService(t *testing.T, ctx context.Context, filename string) *Service {
+	s, err := NewService(Options{
+		Client:               rpcclient.NewClient("http://127.0.0.1:1", "http://127.0.0.1:1"),
+		CachePersistFileName: filename,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServiceStopConcurrent(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.dat")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newPersistedTestService(t, ctx, filename)
+	s.cache.add(validTestEntry(1))
+
+	// stop on ctx done, and explicitly several times at the same time
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() { defer wg.Done(); cancel() }()
+	go func() { defer wg.Done(); s.Stop() }()
+	go func() { defer wg.Done(); s.Stop() }()
+	wg.Wait()
+	s.Stop()
+
+	if s.backend != nil {
+		t.Error("backend not closed")
+	}
+	entries, err := ReadCacheStore(PersistModeFile, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%v entries saved, expected 1", len(entries))
+	}
+}
+
+func TestServiceStopOnContextDone(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.dat")
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newPersistedTestService(t, ctx, filename)
+	s.cache.add(validTestEntry(1))
+	cancel()
+
+	// the final save writes the snapshot, and clears the journal
+	deadline := time.Now().Add(5 * time.Second)
+	for !fileExists(filename) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fileExists(filename) {
+		t.Fatal("cache not saved on ctx done")
+	}
+	s.Stop()
+	if fileNotEmpty(journalFileName(filename)) {
+		t.Error("journal not compacted")
+	}
+}
@@ -3,11 +3,13 @@
 package workcache
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/catenocrypt/nano-work-cache/rpcclient"
@@ -25,20 +27,71 @@ type CacheEntry struct {
 	timeAdded    int64
 }
 
-var (
-	// The cache, key is hash
-	workCache map[string]CacheEntry = map[string]CacheEntry{}
-	// Mutex to protect write and enumeration
-	workCacheLock = &sync.Mutex{}
-	// Time of last addition to cache
-	cacheUpdateTime int64 = 0
-)
+// Default number of shards of the cache
+const defaultCacheShardCount = 32
+
+// workCache The cache of work entries, safe for concurrent use.  The entries are split into shards by hash,
+// each with its own lock, so concurrent requests rarely wait for each other.
+type workCache struct {
+	shards []*cacheShard
+	// Time of last change, unix time; accessed atomically
+	updateTime int64
+	// If set, changes are stored right away; holds a backendRef
+	backend atomic.Value
+	// Newest entry of each account, to detect stale frontiers
+	frontierLock sync.Mutex
+	frontiers    map[string]frontierRef
+}
+
+type backendRef struct {
+	backend cacheBackend
+}
+
+type frontierRef struct {
+	hash         string
+	timeComputed int64
+}
+
+// newWorkCache Create a cache with the given number of shards.  The limits (0 means no limit) are split evenly among the shards.
+func newWorkCache(shardCount int, maxEntries int, maxBytes int64) *workCache {
+	if shardCount <= 0 {
+		shardCount = 1
+	}
+	c := &workCache{shards: make([]*cacheShard, shardCount), frontiers: map[string]frontierRef{}}
+	for i := range c.shards {
+		c.shards[i] = newCacheShard((maxEntries+shardCount-1)/shardCount, (maxBytes+int64(shardCount)-1)/int64(shardCount))
+	}
+	c.backend.Store(backendRef{})
+	return c
+}
 
-func CacheUpdateTime() int64 { return cacheUpdateTime }
+// shardFor Return the shard of a hash (FNV-1a)
+func (c *workCache) shardFor(hash string) *cacheShard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(hash); i++ {
+		h ^= uint32(hash[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// setBackend Set the backend to store changes to; nil to stop storing
+func (c *workCache) setBackend(backend cacheBackend) {
+	c.backend.Store(backendRef{backend})
+}
+
+func (c *workCache) getBackend() cacheBackend {
+	return c.backend.Load().(backendRef).backend
+}
+
+// lastUpdate Return the time of the last change
+func (c *workCache) lastUpdate() int64 {
+	return atomic.LoadInt64(&c.updateTime)
+}
 
 // Add a work result to the cache.  Account is optional (may be empty).
-func addToCache(e rpcclient.WorkResponse, account string, timeComputed int64) {
-	addToCacheInternal(CacheEntry{
+func (c *workCache) addResult(e rpcclient.WorkResponse, account string, timeComputed int64) {
+	c.add(CacheEntry{
 		e.Hash,
 		e.Work,
 		e.Difficulty,
@@ -51,8 +104,8 @@ func addToCache(e rpcclient.WorkResponse, account string, timeComputed int64) {
 }
 
 // Mark in the cache that work request has started
-func addToCacheStart(hash string) {
-	addToCacheInternal(CacheEntry{
+func (c *workCache) addStart(hash string) {
+	c.add(CacheEntry{
 		hash,
 		"",
 		0,
@@ -64,51 +117,147 @@ func addToCacheStart(hash string) {
 	})
 }
 
-func addToCacheInternal(e CacheEntry) {
+func (c *workCache) add(e CacheEntry) {
 	if len(e.hash) == 0 {
 		// empty key, omit
 		return
 	}
-	workCacheLock.Lock()
 	now := time.Now().Unix()
 	e.timeAdded = now
-	workCache[e.hash] = e
-	cacheUpdateTime = now
-	workCacheLock.Unlock()
+	var stale string = ""
+	if cacheIsValid(e) {
+		stale = c.updateFrontier(e)
+		if len(stale) > 0 && stale != e.hash {
+			c.shardFor(stale).markEvictFirst(stale)
+		}
+	}
+	evicted := c.shardFor(e.hash).add(e, stale == e.hash)
+	atomic.StoreInt64(&c.updateTime, now)
+	c.forgetFrontiers(evicted)
+	backend := c.getBackend()
+	if backend != nil && cacheIsValid(e) {
+		if err := backend.put(e); err != nil {
+			log.Println("WARNING", "Could not store cache entry;", err.Error())
+		}
+	}
+	if backend != nil && len(evicted) > 0 {
+		if err := backend.remove(entryHashes(evicted)); err != nil {
+			log.Println("WARNING", "Could not remove evicted cache entries from store;", err.Error())
+		}
+	}
 }
 
-func getFromCache(hash string) (CacheEntry, bool) {
-	workCacheLock.Lock()
-	e, ok := workCache[hash]
-	workCacheLock.Unlock()
+// Remove the in-progress marker of a hash from the cache (if the entry is still in progress)
+func (c *workCache) removeComputing(hash string) {
+	c.shardFor(hash).removeComputing(hash)
+}
+
+// remove Remove an entry, if present
+func (c *workCache) remove(hash string) {
+	e, ok := c.shardFor(hash).remove(hash)
 	if !ok {
-		// not in cache
-		return e, false
+		return
+	}
+	atomic.StoreInt64(&c.updateTime, time.Now().Unix())
+	c.forgetFrontiers([]CacheEntry{e})
+	backend := c.getBackend()
+	if backend != nil {
+		if err := backend.remove([]string{hash}); err != nil {
+			log.Println("WARNING", "Could not remove cache entry from store;", err.Error())
+		}
 	}
-	// found in cache
-	return e, true
 }
 
-func cacheIsValid(e CacheEntry) bool {
-	if e.status == "valid" {
-		return true
+func (c *workCache) get(hash string) (CacheEntry, bool) {
+	return c.shardFor(hash).get(hash)
+}
+
+// size Return the current number of entries in the cache
+func (c *workCache) size() int {
+	var cnt int = 0
+	for _, shard := range c.shards {
+		cnt += shard.size()
 	}
-	return false
+	return cnt
 }
 
-// Note: difficulty may be missing (0)
-func cacheDiffIsOK(e CacheEntry, diff uint64) bool {
-	if diff != 0 && e.difficulty != 0 && e.difficulty < diff {
-		// but diff is smaller
-		return false
+// snapshot Return a copy of all entries.  The shards are copied one by one, only one is locked at a time.
+func (c *workCache) snapshot() []CacheEntry {
+	entries := make([]CacheEntry, 0, c.size())
+	for _, shard := range c.shards {
+		entries = shard.appendEntries(entries)
+	}
+	return entries
+}
+
+// markServed Record that the work of an entry has been returned to a client; it is likely not needed any more
+func (c *workCache) markServed(hash string) {
+	c.shardFor(hash).markServed(hash)
+}
+
+// evictionStats Return the eviction counters, and the estimated memory size of the entries
+func (c *workCache) evictionStats() (CacheEvictionStats, int64) {
+	var stats CacheEvictionStats
+	var bytes int64 = 0
+	for _, shard := range c.shards {
+		s, b := shard.evictionStats()
+		stats.Served += s.Served
+		stats.StaleFrontier += s.StaleFrontier
+		stats.LRU += s.LRU
+		bytes += b
+	}
+	return stats, bytes
+}
+
+// updateFrontier Record a valid entry as the newest of its account, if it is newer than the known one.
+// Returns the hash of the entry that became a stale frontier: the previous newest one, or this one if it is older; empty if none.
+func (c *workCache) updateFrontier(e CacheEntry) string {
+	if len(e.account) == 0 || e.account == "_" {
+		return ""
+	}
+	c.frontierLock.Lock()
+	defer c.frontierLock.Unlock()
+	prev, ok := c.frontiers[e.account]
+	if ok && prev.hash == e.hash {
+		return ""
+	}
+	if ok && prev.timeComputed > e.timeComputed {
+		return e.hash
+	}
+	c.frontiers[e.account] = frontierRef{e.hash, e.timeComputed}
+	if ok {
+		return prev.hash
+	}
+	return ""
+}
+
+// forgetFrontiers Drop removed entries from the frontiers
+func (c *workCache) forgetFrontiers(removed []CacheEntry) {
+	if len(removed) == 0 {
+		return
+	}
+	c.frontierLock.Lock()
+	defer c.frontierLock.Unlock()
+	for _, e := range removed {
+		if f, ok := c.frontiers[e.account]; ok && f.hash == e.hash {
+			delete(c.frontiers, e.account)
+		}
 	}
-	// diff is OK (larger or equal)
-	return true
 }
 
-// StatusCacheSize Return the current number of entries in the cache
-func StatusCacheSize() int {
-	return len(workCache)
+func entryHashes(entries []CacheEntry) []string {
+	hashes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		hashes = append(hashes, e.hash)
+	}
+	return hashes
+}
+
+func cacheIsValid(e CacheEntry) bool {
+	if e.status == "valid" {
+		return true
+	}
+	return false
 }
 
 func padString(val string) string {
@@ -118,7 +267,7 @@ func padString(val string) string {
 	return val
 }
 
-// Convert an entry to a single-line string representation
+// Convert an entry to a single-line string representation (legacy positional format, see encodeEntry)
 func entryToString(entry CacheEntry) string {
 	if len(entry.hash) == 0 {
 		return ""
@@ -152,22 +301,81 @@ func entryLoadFromString(line string, entry *CacheEntry) bool {
 	return true
 }
 
-func RemoveOldEntries(cutoffAgeDays float64) {
-	workCacheLock.Lock()
-	oldSize := len(workCache)
-	var newCache map[string]CacheEntry = make(map[string]CacheEntry, oldSize)
+// cacheEntryJson Serialized form of a cache entry, one JSON object per line.  Unknown fields are ignored,
+// so fields can be added without breaking older readers.
+type cacheEntryJson struct {
+	Hash         string  `json:"hash"`
+	Work         string  `json:"work"`
+	Difficulty   string  `json:"difficulty,omitempty"`
+	Multiplier   float64 `json:"multiplier,omitempty"`
+	Account      string  `json:"account,omitempty"`
+	Status       string  `json:"status"`
+	TimeComputed int64   `json:"time_computed,omitempty"`
+	TimeAdded    int64   `json:"time_added,omitempty"`
+}
+
+// encodeEntry Convert an entry to its single-line serialized form (JSON); empty if it has no hash
+func encodeEntry(entry CacheEntry) string {
+	if len(entry.hash) == 0 {
+		return ""
+	}
+	var difficulty string = ""
+	if entry.difficulty != 0 {
+		difficulty = strconv.FormatUint(entry.difficulty, 16)
+	}
+	line, err := json.Marshal(cacheEntryJson{entry.hash, entry.work, difficulty, entry.multiplier, entry.account,
+		entry.status, entry.timeComputed, entry.timeAdded})
+	if err != nil {
+		return ""
+	}
+	return string(line)
+}
+
+// decodeEntry Fill cache entry from its single-line serialized form: JSON (see encodeEntry),
+// or the legacy positional format (see entryToString).  Returns true on success.
+func decodeEntry(line string, entry *CacheEntry) bool {
+	if !strings.HasPrefix(line, "{") {
+		return entryLoadFromString(line, entry)
+	}
+	var ej cacheEntryJson
+	err := json.Unmarshal([]byte(line), &ej)
+	if err != nil || len(ej.Hash) == 0 {
+		return false
+	}
+	var difficulty uint64 = 0
+	if len(ej.Difficulty) > 0 {
+		difficulty, _ = strconv.ParseUint(ej.Difficulty, 16, 64)
+	}
+	*entry = CacheEntry{ej.Hash, ej.Work, difficulty, ej.Multiplier, ej.Account, ej.Status, ej.TimeComputed, ej.TimeAdded}
+	return true
+}
+
+// isLegacyEntryLine Return true if the line is in the legacy positional format
+func isLegacyEntryLine(line string) bool {
+	return !strings.HasPrefix(line, "{")
+}
+
+// removeOld Remove entries older than the cutoff age.  The shards are processed one by one.
+func (c *workCache) removeOld(cutoffAgeDays float64) {
 	now := time.Now().Unix()
-	for key, entry := range workCache {
-		ageDay := float64(now-entry.timeComputed) / float64(3600*24)
-		if ageDay <= cutoffAgeDays {
-			newCache[key] = entry
-		}
+	cutoffTime := now - int64(cutoffAgeDays*float64(3600*24))
+	oldSize := 0
+	var removed []CacheEntry
+	for _, shard := range c.shards {
+		size, r := shard.removeOlderThan(cutoffTime)
+		oldSize += size
+		removed = append(removed, r...)
 	}
-	newSize := len(newCache)
-	if newSize != oldSize {
-		workCache = newCache
-		cacheUpdateTime = now
-		log.Println("Cache: Removed old entries, size reduced from", oldSize, "to", newSize, "(cutoff", cutoffAgeDays, "days )")
+	if len(removed) == 0 {
+		return
+	}
+	atomic.StoreInt64(&c.updateTime, now)
+	log.Println("Cache: Removed old entries, size reduced from", oldSize, "to", oldSize-len(removed), "(cutoff", cutoffAgeDays, "days )")
+	c.forgetFrontiers(removed)
+	backend := c.getBackend()
+	if backend != nil {
+		if err := backend.remove(entryHashes(removed)); err != nil {
+			log.Println("WARNING", "Could not remove old cache entries from store;", err.Error())
+		}
 	}
-	workCacheLock.Unlock()
 }
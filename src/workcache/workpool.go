@@ -0,0 +1,326 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+const (
+	// StrategyFailover Try peers in configured order, next one only if previous failed
+	StrategyFailover = "failover"
+	// StrategyRoundRobin Distribute requests among peers proportionally to their weights
+	StrategyRoundRobin = "roundrobin"
+	// StrategyLeastLoaded Prefer the peer with the fewest active requests (relative to weight)
+	StrategyLeastLoaded = "leastloaded"
+	// StrategyFastest Prefer the peer with the lowest recent average duration
+	StrategyFastest = "fastest"
+	// StrategyRace Ask all peers at once, take the first valid result, cancel the others
+	StrategyRace = "race"
+)
+
+// Number of recent outcomes kept per peer, for health
+const workPeerRecentSize = 20
+
+// Failure ratio among recent outcomes above which a peer is considered unhealthy
+const workPeerMaxFailureRatio = 0.5
+
+// Weight of the latest duration in the moving average
+const workPeerLatencyAlpha = 0.2
+
+// workPeer A work source in the pool, with its limits and runtime statistics
+type workPeer struct {
+	source    WorkSource
+	weight    int
+	maxActive int
+
+	lock sync.Mutex
+	// current number of active requests
+	active int
+	// for smooth weighted round robin
+	currentWeight int
+	reqCount      int
+	successCount  int
+	durationTotal time.Duration
+	// exponential moving average of successful durations, in ms
+	latencyAvg float64
+	// ring of recent outcomes, true for failure
+	recent    [workPeerRecentSize]bool
+	recentCnt int
+	recentPos int
+}
+
+// WorkPeerStatus Status info of one work peer
+type WorkPeerStatus struct {
+	Name        string  `json:"name"`
+	Healthy     bool    `json:"healthy"`
+	Active      int     `json:"active"`
+	ReqCount    int     `json:"req_count"`
+	SuccessRate float32 `json:"success_rate"`
+	DurAvg      int     `json:"dur_avg"`
+}
+
+// workPool The set of work peers, with the selection strategy
+type workPool struct {
+	peers    []*workPeer
+	strategy string
+	// for round robin
+	rrLock sync.Mutex
+}
+
+// newWorkPool Create the work sources from their configuration
+func newWorkPool(configs []WorkSourceConfig, strategy string, enableCancel bool) *workPool {
+	pool := &workPool{strategy: strategy}
+	for _, cfg := range configs {
+		source, err := newWorkSource(cfg, enableCancel)
+		if err != nil {
+			log.Println("WARNING", "Invalid work source config;", err.Error())
+			continue
+		}
+		weight := cfg.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		pool.peers = append(pool.peers, &workPeer{source: source, weight: weight, maxActive: cfg.MaxActive})
+	}
+	if len(pool.peers) == 0 {
+		log.Println("WARNING", "No work sources configured")
+	}
+	return pool
+}
+
+// healthy A peer is healthy if the source itself is, and not too many of its recent requests failed
+func (p *workPeer) healthy() bool {
+	if !p.source.Healthy() {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.recentCnt < workPeerRecentSize/4 {
+		return true
+	}
+	failures := 0
+	for i := 0; i < p.recentCnt; i++ {
+		if p.recent[i] {
+			failures++
+		}
+	}
+	return float64(failures)/float64(p.recentCnt) <= workPeerMaxFailureRatio
+}
+
+// tryAcquire Reserve a request slot, false if the peer is at its limit
+func (p *workPeer) tryAcquire() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxActive > 0 && p.active >= p.maxActive {
+		return false
+	}
+	p.active++
+	p.reqCount++
+	return true
+}
+
+// release Free the request slot, and record the outcome.  Cancelled requests are not counted as failures.
+func (p *workPeer) release(err error, duration time.Duration, cancelled bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.active--
+	if cancelled {
+		p.reqCount--
+		return
+	}
+	failed := err != nil
+	p.recent[p.recentPos] = failed
+	p.recentPos = (p.recentPos + 1) % workPeerRecentSize
+	if p.recentCnt < workPeerRecentSize {
+		p.recentCnt++
+	}
+	if failed {
+		return
+	}
+	p.successCount++
+	p.durationTotal += duration
+	ms := float64(duration.Milliseconds())
+	if p.successCount == 1 {
+		p.latencyAvg = ms
+	} else {
+		p.latencyAvg = workPeerLatencyAlpha*ms + (1-workPeerLatencyAlpha)*p.latencyAvg
+	}
+}
+
+func (p *workPeer) load() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return float64(p.active) / float64(p.weight)
+}
+
+func (p *workPeer) latency() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.latencyAvg
+}
+
+func (p *workPeer) status() WorkPeerStatus {
+	healthy := p.healthy()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var successRate float32 = 0
+	done := p.reqCount - p.active
+	if done > 0 {
+		successRate = float32(p.successCount) / float32(done)
+	}
+	var durAvg int = 0
+	if p.successCount > 0 {
+		durAvg = int(p.durationTotal.Milliseconds() / int64(p.successCount))
+	}
+	return WorkPeerStatus{p.source.Name(), healthy, p.active, p.reqCount, successRate, durAvg}
+}
+
+// candidates Return the peers to try, in order, according to the strategy.
+// Unhealthy peers are left out, unless all of them are unhealthy.
+func (pool *workPool) candidates() []*workPeer {
+	peers := make([]*workPeer, 0, len(pool.peers))
+	for _, p := range pool.peers {
+		if p.healthy() {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		peers = append(peers, pool.peers...)
+	}
+	switch pool.strategy {
+	case StrategyRoundRobin:
+		first := pool.nextRoundRobin(peers)
+		for i, p := range peers {
+			if p == first {
+				// selected one first, others as fallback, in order
+				peers = append([]*workPeer{first}, append(peers[:i:i], peers[i+1:]...)...)
+				break
+			}
+		}
+	case StrategyLeastLoaded:
+		sort.SliceStable(peers, func(i, j int) bool { return peers[i].load() < peers[j].load() })
+	case StrategyFastest:
+		// peers without measurement yet (0) come first, to get measured
+		sort.SliceStable(peers, func(i, j int) bool { return peers[i].latency() < peers[j].latency() })
+	}
+	return peers
+}
+
+// nextRoundRobin Select the next peer by smooth weighted round robin
+func (pool *workPool) nextRoundRobin(peers []*workPeer) *workPeer {
+	pool.rrLock.Lock()
+	defer pool.rrLock.Unlock()
+	var best *workPeer = nil
+	total := 0
+	for _, p := range peers {
+		p.currentWeight += p.weight
+		total += p.weight
+		if best == nil || p.currentWeight > best.currentWeight {
+			best = p
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// generateOn Generate work on one peer, with accounting.  Returns false if the peer had no free slot.
+func (p *workPeer) generateOn(ctx context.Context, req WorkRequest) (rpcclient.WorkResponse, error, bool) {
+	if !p.tryAcquire() {
+		return rpcclient.WorkResponse{}, nil, false
+	}
+	timeStart := time.Now()
+	resp, err := p.source.Generate(ctx, req.Hash, req.Diff)
+	p.release(err, time.Now().Sub(timeStart), err != nil && ctx.Err() != nil)
+	return resp, err, true
+}
+
+// generate Obtain work from the pool, according to the strategy.  The returned work is validated.
+func (pool *workPool) generate(ctx context.Context, req WorkRequest) (rpcclient.WorkResponse, error) {
+	if len(pool.peers) == 0 {
+		return rpcclient.WorkResponse{}, ErrNoWorkSource
+	}
+	peers := pool.candidates()
+	if pool.strategy == StrategyRace {
+		return pool.generateRace(ctx, req, peers)
+	}
+	err := fmt.Errorf("%w: all work sources are at their limit", ErrOverload)
+	for _, p := range peers {
+		resp, err1, tried := p.generateOn(ctx, req)
+		if !tried {
+			continue
+		}
+		if err1 == nil {
+			return resp, nil
+		}
+		err = err1
+		log.Println("WARNING", "Could not get work from source", p.source.Name(), ";", err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return rpcclient.WorkResponse{}, err
+}
+
+type raceResult struct {
+	resp rpcclient.WorkResponse
+	err  error
+}
+
+// generateRace Ask all peers at once, the first valid result wins, the others are cancelled
+func (pool *workPool) generateRace(ctx context.Context, req WorkRequest, peers []*workPeer) (rpcclient.WorkResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(peers))
+	started := 0
+	for _, p := range peers {
+		if !p.tryAcquire() {
+			continue
+		}
+		started++
+		go func(p *workPeer) {
+			timeStart := time.Now()
+			resp, err := p.source.Generate(ctx, req.Hash, req.Diff)
+			p.release(err, time.Now().Sub(timeStart), err != nil && ctx.Err() != nil)
+			results <- raceResult{resp, err}
+		}(p)
+	}
+	if started == 0 {
+		return rpcclient.WorkResponse{}, fmt.Errorf("%w: all work sources are at their limit", ErrOverload)
+	}
+	var err error
+	for i := 0; i < started; i++ {
+		res := <-results
+		if res.err == nil {
+			// winner; the others are cancelled on return
+			return res.resp, nil
+		}
+		err = res.err
+	}
+	return rpcclient.WorkResponse{}, err
+}
+
+// getWorkFromSource Obtain work from the work sources, according to the configured strategy.
+// The returned work is validated.
+func (s *Service) getWorkFromSource(ctx context.Context, req WorkRequest) (rpcclient.WorkResponse, error, time.Duration) {
+	timeStart := time.Now()
+	resp, err := s.pool.generate(ctx, req)
+	return resp, err, time.Now().Sub(timeStart)
+}
+
+// StatusWorkPeers Return status info of the work peers
+func (s *Service) StatusWorkPeers() []WorkPeerStatus {
+	pool := s.pool
+	res := make([]WorkPeerStatus, 0, len(pool.peers))
+	for _, p := range pool.peers {
+		res = append(res, p.status())
+	}
+	return res
+}
@@ -0,0 +1,291 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+// fakeSource A work source for the tests: it fails, blocks until cancelled, or returns work after a delay
+type fakeSource struct {
+	name      string
+	unhealthy bool
+	fail      bool
+	block     bool
+	delay     time.Duration
+
+	lock      sync.Mutex
+	calls     int
+	cancelled int
+}
+
+func (f *fakeSource) Name() string  { return f.name }
+func (f *fakeSource) Healthy() bool { return !f.unhealthy }
+
+func (f *fakeSource) Generate(ctx context.Context, hash string, diff uint64) (rpcclient.WorkResponse, error) {
+	f.lock.Lock()
+	f.calls++
+	f.lock.Unlock()
+	if f.fail {
+		return rpcclient.WorkResponse{}, errors.New("failed " + f.name)
+	}
+	if f.block || f.delay > 0 {
+		var timeout <-chan time.Time = nil
+		if !f.block {
+			timeout = time.After(f.delay)
+		}
+		select {
+		case <-timeout:
+		case <-ctx.Done():
+			f.lock.Lock()
+			f.cancelled++
+			f.lock.Unlock()
+			return rpcclient.WorkResponse{}, ctx.Err()
+		}
+	}
+	return rpcclient.WorkResponse{Hash: hash, Work: f.name}, nil
+}
+
+func (f *fakeSource) counts() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls, f.cancelled
+}
+
+// newTestPool Create a pool of the sources; weights are optional (default 1)
+func newTestPool(strategy string, sources []*fakeSource, weights ...int) *workPool {
+	pool := &workPool{strategy: strategy}
+	for i, f := range sources {
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		pool.peers = append(pool.peers, &workPeer{source: f, weight: weight})
+	}
+	return pool
+}
+
+func newFakeSources(n int) []*fakeSource {
+	sources := make([]*fakeSource, n)
+	for i := range sources {
+		sources[i] = &fakeSource{name: fmt.Sprintf("s%v", i)}
+	}
+	return sources
+}
+
+// peerNames Return the names of the peers, in order
+func peerNames(peers []*workPeer) string {
+	names := ""
+	for _, p := range peers {
+		names += p.source.Name() + " "
+	}
+	return names
+}
+
+func TestRoundRobinDistribution(t *testing.T) {
+	tests := []struct {
+		weights []int
+	}{
+		{[]int{1, 1}},
+		{[]int{3, 1}},
+		{[]int{5, 1, 2}},
+		{[]int{1, 1, 1, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.weights), func(t *testing.T) {
+			pool := newTestPool(StrategyRoundRobin, newFakeSources(len(tt.weights)), tt.weights...)
+			total := 0
+			for _, w := range tt.weights {
+				total += w
+			}
+			// each full cycle of total selections gives each peer exactly its weight
+			const cycles = 50
+			counts := map[string]int{}
+			for i := 0; i < cycles*total; i++ {
+				peers := pool.candidates()
+				if len(peers) != len(tt.weights) {
+					t.Fatalf("%v candidates, expected all %v as fallback", len(peers), len(tt.weights))
+				}
+				counts[peers[0].source.Name()]++
+			}
+			for i, w := range tt.weights {
+				name := fmt.Sprintf("s%v", i)
+				if counts[name] != cycles*w {
+					t.Errorf("peer %v selected %v times, expected %v", name, counts[name], cycles*w)
+				}
+			}
+		})
+	}
+}
+
+func TestCandidatesOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		weights  []int
+		active   []int
+		latency  []float64
+		expected string
+	}{
+		{"failover keeps the configured order", StrategyFailover, nil, []int{3, 0, 1}, []float64{300, 100, 200}, "s0 s1 s2 "},
+		{"least loaded", StrategyLeastLoaded, nil, []int{3, 0, 1}, nil, "s1 s2 s0 "},
+		{"least loaded, relative to weight", StrategyLeastLoaded, []int{4, 1, 1}, []int{2, 1, 0}, nil, "s2 s0 s1 "},
+		{"least loaded, ties in configured order", StrategyLeastLoaded, nil, []int{1, 0, 0}, nil, "s1 s2 s0 "},
+		{"fastest", StrategyFastest, nil, nil, []float64{300, 100, 200}, "s1 s2 s0 "},
+		{"fastest, unmeasured first", StrategyFastest, nil, nil, []float64{300, 100, 0}, "s2 s1 s0 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(tt.strategy, newFakeSources(3), tt.weights...)
+			for i, p := range pool.peers {
+				if i < len(tt.active) {
+					p.active = tt.active[i]
+				}
+				if i < len(tt.latency) {
+					p.latencyAvg = tt.latency[i]
+				}
+			}
+			if names := peerNames(pool.candidates()); names != tt.expected {
+				t.Errorf("order %v, expected %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+// waitIdle Wait until no peer has an active request
+func waitIdle(t *testing.T, pool *workPool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, p := range pool.peers {
+		for {
+			p.lock.Lock()
+			active := p.active
+			p.lock.Unlock()
+			if active == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("peer %v still active", p.source.Name())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestGenerateRace(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []*fakeSource
+		// expected winner, empty for error
+		winner string
+		// expected number of cancelled and failed requests
+		cancelled int
+		failed    int
+	}{
+		{"fastest wins, others cancelled",
+			[]*fakeSource{{name: "slow", block: true}, {name: "fast", delay: time.Millisecond}, {name: "slow2", block: true}},
+			"fast", 2, 0},
+		{"failure does not end the race",
+			[]*fakeSource{{name: "bad", fail: true}, {name: "good", delay: 10 * time.Millisecond}},
+			"good", 0, 1},
+		{"all fail",
+			[]*fakeSource{{name: "bad", fail: true}, {name: "bad2", fail: true}},
+			"", 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(StrategyRace, tt.sources)
+			resp, err := pool.generate(context.Background(), WorkRequest{WorkInputHash, testEntry(1).hash, 1, ""})
+			if len(tt.winner) == 0 {
+				if err == nil {
+					t.Errorf("no error, work from %v", resp.Work)
+				}
+			} else if err != nil || resp.Work != tt.winner {
+				t.Errorf("work from %v err %v, expected from %v", resp.Work, err, tt.winner)
+			}
+			waitIdle(t, pool)
+			cancelled := 0
+			failed := 0
+			for _, p := range pool.peers {
+				calls, c := p.source.(*fakeSource).counts()
+				if calls != 1 {
+					t.Errorf("peer %v asked %v times", p.source.Name(), calls)
+				}
+				cancelled += c
+				p.lock.Lock()
+				for i := 0; i < p.recentCnt; i++ {
+					if p.recent[i] {
+						failed++
+					}
+				}
+				if c > 0 && p.reqCount != 0 {
+					t.Errorf("cancelled peer %v has request count %v", p.source.Name(), p.reqCount)
+				}
+				p.lock.Unlock()
+			}
+			if cancelled != tt.cancelled || failed != tt.failed {
+				t.Errorf("cancelled %v failed %v, expected %v %v", cancelled, failed, tt.cancelled, tt.failed)
+			}
+		})
+	}
+}
+
+func TestUnhealthyPeersSkipped(t *testing.T) {
+	tests := []struct {
+		name string
+		// unhealthy sources, by index
+		unhealthy []int
+		// number of recent failures, of workPeerRecentSize outcomes, per peer
+		failures []int
+		expected string
+	}{
+		{"all healthy", nil, nil, "s0 s1 s2 "},
+		{"source unhealthy", []int{0}, nil, "s1 s2 "},
+		{"too many recent failures", nil, []int{0, workPeerRecentSize/2 + 1, 0}, "s0 s2 "},
+		{"failures below the ratio", nil, []int{workPeerRecentSize / 2, 0, 0}, "s0 s1 s2 "},
+		{"all unhealthy, all used", []int{0, 1}, []int{0, 0, workPeerRecentSize}, "s0 s1 s2 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := newFakeSources(3)
+			for _, i := range tt.unhealthy {
+				sources[i].unhealthy = true
+			}
+			pool := newTestPool(StrategyFailover, sources)
+			for i, p := range pool.peers {
+				if i >= len(tt.failures) {
+					continue
+				}
+				for j := 0; j < workPeerRecentSize; j++ {
+					var err error = nil
+					if j < tt.failures[i] {
+						err = errors.New("failed")
+					}
+					p.active++
+					p.release(err, time.Millisecond, false)
+				}
+			}
+			if names := peerNames(pool.candidates()); names != tt.expected {
+				t.Errorf("candidates %v, expected %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFailoverToNextPeer(t *testing.T) {
+	sources := []*fakeSource{{name: "bad", fail: true}, {name: "good"}, {name: "unused"}}
+	pool := newTestPool(StrategyFailover, sources)
+	resp, err := pool.generate(context.Background(), WorkRequest{WorkInputHash, testEntry(1).hash, 1, ""})
+	if err != nil || resp.Work != "good" {
+		t.Errorf("work from %v err %v, expected from good", resp.Work, err)
+	}
+	if calls, _ := sources[2].counts(); calls != 0 {
+		t.Errorf("next peer asked after success")
+	}
+}
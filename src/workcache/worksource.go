@@ -0,0 +1,217 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catenocrypt/nano-work-cache/rpcclient"
+)
+
+// WorkSource A backend which can generate work: a node, a work server, local CPU, etc.
+type WorkSource interface {
+	// Name Short name of the source, used in logs and status
+	Name() string
+	// Generate Generate work for the hash, with at least the given difficulty (0 means default).
+	// Blocks until work is obtained, or ctx is cancelled.  Generations are cancelled through ctx (losers of a race,
+	// abandoned requests); remote sources are then also asked to stop (work_cancel), if enabled.
+	Generate(ctx context.Context, hash string, diff uint64) (rpcclient.WorkResponse, error)
+	// Healthy Return false if the source has been failing recently
+	Healthy() bool
+}
+
+const (
+	WorkSourceTypeNode       = "node"
+	WorkSourceTypeWorkServer = "workserver"
+	WorkSourceTypeCpu        = "cpu"
+)
+
+// WorkSourceConfig Configuration of one work source, see the [[WorkSource]] config entries
+type WorkSourceConfig struct {
+	// node, workserver, or cpu
+	Type string
+	// URL of node or work server
+	Url string
+	// Number of threads, for cpu
+	Threads int
+	// Time limit for one generation; for node and workserver 0 means no limit
+	TimeoutSec int
+	// Relative weight, for load balancing; default 1
+	Weight int
+	// Max number of concurrent requests to this source; 0 means no limit
+	MaxActive int
+}
+
+// NewWorkSource Create a work source from its configuration
+func NewWorkSource(cfg WorkSourceConfig) (WorkSource, error) {
+	return newWorkSource(cfg, true)
+}
+
+// newWorkSource Create a work source; if enableCancel is set, remote sources are sent work_cancel for abandoned generations
+func newWorkSource(cfg WorkSourceConfig, enableCancel bool) (WorkSource, error) {
+	switch cfg.Type {
+	case WorkSourceTypeNode, WorkSourceTypeWorkServer:
+		if len(cfg.Url) == 0 {
+			return nil, fmt.Errorf("Missing Url for work source of type %v", cfg.Type)
+		}
+		var timeout time.Duration = 0
+		if cfg.TimeoutSec > 0 {
+			timeout = time.Duration(cfg.TimeoutSec) * time.Second
+		}
+		return &rpcWorkSource{
+			workSourceBase: newWorkSourceBase(cfg.Type + ":" + cfg.Url),
+			url:            cfg.Url,
+			usePeers:       cfg.Type == WorkSourceTypeNode,
+			timeout:        timeout,
+			enableCancel:   enableCancel,
+		}, nil
+	case WorkSourceTypeCpu:
+		threads := cfg.Threads
+		if threads < 1 {
+			threads = 1
+		}
+		timeoutSec := cfg.TimeoutSec
+		if timeoutSec < 1 {
+			timeoutSec = 120
+		}
+		return &cpuWorkSource{
+			workSourceBase: newWorkSourceBase(fmt.Sprintf("cpu:%v", threads)),
+			threads:        threads,
+			timeout:        time.Duration(timeoutSec) * time.Second,
+		}, nil
+	default:
+		return nil, errors.New("Unknown work source type " + cfg.Type)
+	}
+}
+
+// Failures in a row after which a source is considered unhealthy
+const workSourceMaxFailures = 3
+
+// Time after which an unhealthy source is tried again
+const workSourceRetryAfter = 30 * time.Second
+
+// workSourceBase Common part of work sources: name, health tracking
+type workSourceBase struct {
+	name                string
+	lock                sync.Mutex
+	consecutiveFailures int
+	lastFailure         time.Time
+}
+
+func newWorkSourceBase(name string) workSourceBase {
+	return workSourceBase{name: name}
+}
+
+func (s *workSourceBase) Name() string { return s.name }
+
+func (s *workSourceBase) Healthy() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.consecutiveFailures < workSourceMaxFailures {
+		return true
+	}
+	// failing, but try again after some time
+	return time.Now().Sub(s.lastFailure) > workSourceRetryAfter
+}
+
+// report Record the outcome of a generation, for health tracking.  Cancellation is not a failure.
+func (s *workSourceBase) report(ctx context.Context, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		s.consecutiveFailures = 0
+		return
+	}
+	s.consecutiveFailures++
+	s.lastFailure = time.Now()
+}
+
+// rpcWorkSource Work from a node (with its work peers), or from a standalone nano-work-server, over RPC
+type rpcWorkSource struct {
+	workSourceBase
+	url      string
+	usePeers bool
+	// time limit for one generation, 0 means no limit
+	timeout time.Duration
+	// if set, work_cancel is sent for abandoned generations
+	enableCancel bool
+}
+
+func (s *rpcWorkSource) Generate(ctx context.Context, hash string, diff uint64) (rpcclient.WorkResponse, error) {
+	// a timeout is a failure of the source, unlike cancellation, so it is kept on a separate context
+	callCtx := ctx
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	resp, err, _ := rpcclient.GetWorkFrom(callCtx, s.url, hash, diff, s.usePeers)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded)) {
+		// abandoned (cancelled or timed out), stop work on the peer too
+		go s.sendCancel(hash)
+	}
+	if err == nil {
+		err = validateWorkResponse(&resp, hash, diff)
+	}
+	s.report(ctx, err)
+	return resp, err
+}
+
+// sendCancel Send work_cancel to the node or work server, so it does not waste resources
+func (s *rpcWorkSource) sendCancel(hash string) {
+	if !s.enableCancel {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := rpcclient.CancelWorkAt(ctx, s.url, hash)
+	if err != nil {
+		log.Println("WARNING", "Could not cancel work at", s.url, ";", err.Error())
+	}
+}
+
+// cpuWorkSource Work computed locally on CPU
+type cpuWorkSource struct {
+	workSourceBase
+	threads int
+	timeout time.Duration
+}
+
+func (s *cpuWorkSource) Generate(ctx context.Context, hash string, diff uint64) (rpcclient.WorkResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	log.Printf("Generating work on CPU, threads %v hash %v \n", s.threads, hash)
+	work, actualDiff, err := GenerateWorkCpu(ctx, hash, diff, s.threads)
+	s.report(ctx, err)
+	if err != nil {
+		return rpcclient.WorkResponse{}, err
+	}
+	return rpcclient.WorkResponse{Hash: hash, Work: work, Difficulty: actualDiff, Multiplier: DifficultyMultiplier(actualDiff)}, nil
+}
+
+// validateWorkResponse Verify work locally, the reported difficulty is not trusted.  Fills actual difficulty.
+func validateWorkResponse(resp *rpcclient.WorkResponse, hash string, diff uint64) error {
+	if len(resp.Hash) == 0 {
+		resp.Hash = hash
+	} // for the case if hash is missing in the response
+	if !strings.EqualFold(resp.Hash, hash) {
+		return errors.New("Hash mismatch in work response " + resp.Hash)
+	}
+	resp.Hash = hash
+	actualDiff, err := ValidateWork(resp.Hash, resp.Work, diff)
+	if err != nil {
+		return err
+	}
+	resp.Difficulty = actualDiff
+	resp.Multiplier = DifficultyMultiplier(actualDiff)
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// BaseDifficulty The network base (minimum) difficulty, reference for multipliers
+const BaseDifficulty uint64 = 0xffffffc000000000
+
+// parseHash Parse a block hash (64 hex digits) into bytes
+func parseHash(hash string) ([]byte, error) {
+	if len(hash) != 64 {
+		return nil, fmt.Errorf("Invalid hash length %v", len(hash))
+	}
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hash, %v", err.Error())
+	}
+	return hashBytes, nil
+}
+
+// IsHashValid Check if a block hash looks valid: 64 hex digits
+func IsHashValid(hash string) bool {
+	_, err := parseHash(hash)
+	return err == nil
+}
+
+// Alphabet of the base32 encoding of account numbers
+const accountAlphabet = "13456789abcdefghijkmnopqrstuwxyz"
+
+// decodeAccountBase32 Decode base32 characters of an account number into bits, the most significant first; false on invalid character
+func decodeAccountBase32(s string) ([]byte, bool) {
+	bits := make([]byte, 0, 5*len(s))
+	for i := 0; i < len(s); i++ {
+		v := strings.IndexByte(accountAlphabet, s[i])
+		if v < 0 {
+			return nil, false
+		}
+		for b := 4; b >= 0; b-- {
+			bits = append(bits, byte(v>>uint(b))&1)
+		}
+	}
+	return bits, true
+}
+
+// IsAccountValid Check if an account number is valid: nano_ or xrb_ prefix, public key and matching checksum
+func IsAccountValid(account string) bool {
+	var encoded string
+	switch {
+	case strings.HasPrefix(account, "nano_"):
+		encoded = account[5:]
+	case strings.HasPrefix(account, "xrb_"):
+		encoded = account[4:]
+	default:
+		return false
+	}
+	// 4 zero padding bits and 256 bits of public key, then 40 bits of checksum
+	if len(encoded) != 60 {
+		return false
+	}
+	bits, ok := decodeAccountBase32(encoded)
+	if !ok {
+		return false
+	}
+	for _, bit := range bits[:4] {
+		if bit != 0 {
+			return false
+		}
+	}
+	data := make([]byte, 37)
+	for i, bit := range bits[4:] {
+		data[i/8] |= bit << uint(7-i%8)
+	}
+	pubKey, checksum := data[:32], data[32:]
+	h, _ := blake2b.New(5, nil)
+	h.Write(pubKey)
+	expected := h.Sum(nil)
+	// the checksum is encoded in reverse byte order
+	for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+		expected[i], expected[j] = expected[j], expected[i]
+	}
+	return bytes.Equal(checksum, expected)
+}
+
+// workValue Compute the work value (difficulty) of a work nonce for a hash; blake2b-64 of work (little endian) and hash
+func workValue(work uint64, hashBytes []byte) uint64 {
+	var workBytes [8]byte
+	binary.LittleEndian.PutUint64(workBytes[:], work)
+	h, _ := blake2b.New(8, nil)
+	h.Write(workBytes[:])
+	h.Write(hashBytes)
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// WorkDifficulty Compute the actual difficulty of a work value for a given hash
+func WorkDifficulty(hash string, work string) (uint64, error) {
+	hashBytes, err := parseHash(hash)
+	if err != nil {
+		return 0, err
+	}
+	if !IsWorkValueValid(work) {
+		return 0, fmt.Errorf("Invalid work value '%v'", work)
+	}
+	workNum, err := strconv.ParseUint(work, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid work value '%v', %v", work, err.Error())
+	}
+	return workValue(workNum, hashBytes), nil
+}
+
+// ValidateWork Check that work is valid for the hash, and reaches the given difficulty (0 means base difficulty).
+// Returns the actual difficulty of the work.
+func ValidateWork(hash string, work string, diff uint64) (uint64, error) {
+	actualDiff, err := WorkDifficulty(hash, work)
+	if err != nil {
+		return 0, err
+	}
+	if diff == 0 {
+		diff = BaseDifficulty
+	}
+	if actualDiff < diff {
+		return actualDiff, fmt.Errorf("Work difficulty too low, %x < %x, hash %v work %v", actualDiff, diff, hash, work)
+	}
+	return actualDiff, nil
+}
+
+// DifficultyMultiplier Compute the multiplier of a difficulty relative to the base difficulty
+func DifficultyMultiplier(diff uint64) float64 {
+	if diff == 0 {
+		return 0
+	}
+	return float64(^BaseDifficulty+1) / float64(^diff+1)
+}
@@ -0,0 +1,37 @@
+// Copyright © 2019-2020 catenocrypt.  See LICENSE file for license information.
+
+package workcache
+
+import (
+	"testing"
+)
+
+func TestIsAccountValid(t *testing.T) {
+	// genesis account
+	const genesis = "3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3"
+	tests := []struct {
+		account string
+		valid   bool
+	}{
+		{"nano_" + genesis, true},
+		{"xrb_" + genesis, true},
+		{"ban_" + genesis, false},
+		{genesis, false},
+		{"nano_" + genesis[:59], false},
+		{"nano_" + genesis + "1", false},
+		// checksum mismatch
+		{"nano_" + genesis[:59] + "1", false},
+		// public key changed
+		{"nano_" + genesis[:20] + "a" + genesis[21:], false},
+		// invalid character (0, l, v are not in the alphabet)
+		{"nano_" + genesis[:10] + "0" + genesis[11:], false},
+		// padding bits must be 0
+		{"nano_4" + genesis[1:], false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if IsAccountValid(tt.account) != tt.valid {
+			t.Errorf("account %v valid %v, expected %v", tt.account, !tt.valid, tt.valid)
+		}
+	}
+}